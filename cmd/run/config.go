@@ -1,15 +1,19 @@
 package run
 import (
     "github.com/page31/aws-meta-server/services/aws"
+    "github.com/page31/aws-meta-server/services/consul"
     "github.com/page31/aws-meta-server/services/httpd"
     "github.com/page31/aws-meta-server/services/named"
     "gopkg.in/gcfg.v1"
 )
 
 type ServerConfig struct {
-    AWS  aws.Config
-    HTTP httpd.Config
-    DNS  named.Config
+    AWS       aws.Config
+    AWSSource map[string]*aws.SourceConfig
+    HTTP      httpd.Config
+    DNS       named.Config
+    DNSView   map[string]*named.ViewConfig
+    Consul    consul.Config
 }
 
 func NewConfig(file string) (error, *ServerConfig) {
@@ -19,5 +23,11 @@ func NewConfig(file string) (error, *ServerConfig) {
 }
 
 func (c *ServerConfig) init(file string) error {
-    return gcfg.ReadFileInto(c, file)
+    if err := gcfg.ReadFileInto(c, file); err != nil {
+        return err
+    }
+    c.AWS.Sources = c.AWSSource
+    c.AWS.SRVTag = c.DNS.SRVTag
+    c.DNS.Views = c.DNSView
+    return nil
 }
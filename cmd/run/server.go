@@ -3,16 +3,18 @@ package run
 import (
     "errors"
     "github.com/page31/aws-meta-server/services/aws"
+    "github.com/page31/aws-meta-server/services/consul"
     "github.com/page31/aws-meta-server/services/named"
     "github.com/page31/aws-meta-server/services/httpd"
 )
 
 type Server struct {
-    Config      ServerConfig
-    Services    []Service
-    awsService  *aws.Service
-    dnsService  *named.Service
-    httpService *httpd.Service
+    Config        ServerConfig
+    Services      []Service
+    awsService    *aws.Service
+    dnsService    *named.Service
+    httpService   *httpd.Service
+    consulService *consul.Service
 }
 
 type Service interface {
@@ -28,6 +30,7 @@ func NewServer(c *ServerConfig) *Server {
     s.appendAWSService(c.AWS)
     s.appendDNSService(c.DNS)
     s.appendHTTPService(c.HTTP)
+    s.appendConsulService(c.Consul)
     return s
 }
 
@@ -77,3 +80,11 @@ func (s *Server) appendHTTPService(c httpd.Config) {
         s.Services = append(s.Services, s.httpService)
     }
 }
+
+func (s *Server) appendConsulService(c consul.Config) {
+    if c.Enabled {
+        s.consulService = consul.NewService(c)
+        s.consulService.AWSService = s.awsService
+        s.Services = append(s.Services, s.consulService)
+    }
+}
@@ -0,0 +1,169 @@
+package aws
+
+import (
+    "context"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+    ResourceInstance         = "instance"
+    ResourceNetworkInterface = "network_interface"
+    ResourceElasticIP        = "elastic_ip"
+    ResourceNATGateway       = "nat_gateway"
+    ResourceLambda           = "lambda"
+    ResourceLoadBalancer     = "load_balancer"
+    ResourceVpcEndpoint      = "vpc_endpoint"
+)
+
+// NetworkAddress records which resource owns an address in the VPC, found
+// through its ENI or Elastic IP.
+type NetworkAddress struct {
+    IP           string
+    Public       bool
+    ResourceType string
+    ResourceID   string
+    Name         string
+    InterfaceID  string
+    AllocationID string
+    Description  string
+    VpcID        string
+    Source       string
+    Account      string
+    Region       string
+    UpdateTime   time.Time
+}
+
+// AddressOwner answers "what is this IP".
+type AddressOwner struct {
+    IP           string
+    ResourceType string
+    ResourceID   string
+    Name         string
+}
+
+func (s *EC2Source) listAddresses(ctx context.Context) (error, []*NetworkAddress) {
+    addresses := make([]*NetworkAddress, 0, 10)
+    err := s.retryThrottled(ctx, "describe network interfaces", func() error {
+        addresses = addresses[:0]
+        return s.client.DescribeNetworkInterfacesPagesWithContext(ctx, &ec2.DescribeNetworkInterfacesInput{
+            MaxResults: aws.Int64(s.pageSize),
+        }, func(page *ec2.DescribeNetworkInterfacesOutput, lastPage bool) bool {
+            for _, eni := range page.NetworkInterfaces {
+                addresses = append(addresses, newENIAddresses(eni)...)
+            }
+            return true
+        })
+    })
+    if err != nil {
+        return err, nil
+    }
+    eniCount := len(addresses)
+    var resp *ec2.DescribeAddressesOutput
+    err = s.retryThrottled(ctx, "describe addresses", func() error {
+        var err error
+        resp, err = s.client.DescribeAddressesWithContext(ctx, &ec2.DescribeAddressesInput{})
+        return err
+    })
+    if err != nil {
+        return err, nil
+    }
+    for _, eip := range resp.Addresses {
+        addresses = append(addresses, newElasticIPAddress(eip))
+    }
+    account := s.Account(ctx)
+    for _, addr := range addresses {
+        addr.Source = s.Name
+        addr.Account = account
+        addr.Region = s.Region
+    }
+    s.logger.Printf("%s: fetched %d eni addresses and %d elastic ips", s, eniCount, len(addresses) - eniCount)
+    return nil, addresses
+}
+
+func newENIAddresses(eni *ec2.NetworkInterface) []*NetworkAddress {
+    resourceType, resourceID := eniOwner(eni)
+    name := ""
+    for _, tag := range eni.TagSet {
+        if aws.StringValue(tag.Key) == "Name" {
+            name = aws.StringValue(tag.Value)
+        }
+    }
+    now := time.Now()
+    base := NetworkAddress{
+        ResourceType: resourceType,
+        ResourceID: resourceID,
+        Name: name,
+        InterfaceID: aws.StringValue(eni.NetworkInterfaceId),
+        Description: aws.StringValue(eni.Description),
+        VpcID: aws.StringValue(eni.VpcId),
+        UpdateTime: now,
+    }
+    addresses := make([]*NetworkAddress, 0, len(eni.PrivateIpAddresses) + len(eni.Ipv6Addresses))
+    add := func(ip string, public bool, allocationID string) {
+        addr := base
+        addr.IP = ip
+        addr.Public = public
+        addr.AllocationID = allocationID
+        addresses = append(addresses, &addr)
+    }
+    for _, private := range eni.PrivateIpAddresses {
+        add(aws.StringValue(private.PrivateIpAddress), false, "")
+        if private.Association != nil && private.Association.PublicIp != nil {
+            add(aws.StringValue(private.Association.PublicIp), true, aws.StringValue(private.Association.AllocationId))
+        }
+    }
+    for _, ipv6 := range eni.Ipv6Addresses {
+        add(aws.StringValue(ipv6.Ipv6Address), true, "")
+    }
+    return addresses
+}
+
+// eniOwner works out what an ENI belongs to. Managed interfaces only name
+// their owner in the description, e.g. "Interface for NAT Gateway nat-0abc"
+// or "ELB app/web/0123456789abcdef".
+func eniOwner(eni *ec2.NetworkInterface) (string, string) {
+    description := aws.StringValue(eni.Description)
+    if eni.Attachment != nil && eni.Attachment.InstanceId != nil {
+        return ResourceInstance, aws.StringValue(eni.Attachment.InstanceId)
+    }
+    switch aws.StringValue(eni.InterfaceType) {
+    case "nat_gateway":
+        return ResourceNATGateway, description[strings.LastIndex(description, " ") + 1:]
+    case "lambda":
+        return ResourceLambda, strings.TrimPrefix(description, "AWS Lambda VPC ENI-")
+    case "network_load_balancer", "gateway_load_balancer":
+        return ResourceLoadBalancer, strings.TrimPrefix(description, "ELB ")
+    case "vpc_endpoint", "gateway_load_balancer_endpoint":
+        return ResourceVpcEndpoint, strings.TrimPrefix(description, "VPC Endpoint Interface ")
+    }
+    if strings.HasPrefix(description, "ELB ") {
+        return ResourceLoadBalancer, strings.TrimPrefix(description, "ELB ")
+    }
+    return ResourceNetworkInterface, aws.StringValue(eni.NetworkInterfaceId)
+}
+
+func newElasticIPAddress(eip *ec2.Address) *NetworkAddress {
+    addr := &NetworkAddress{
+        IP: aws.StringValue(eip.PublicIp),
+        Public: true,
+        ResourceType: ResourceElasticIP,
+        ResourceID: aws.StringValue(eip.AllocationId),
+        AllocationID: aws.StringValue(eip.AllocationId),
+        InterfaceID: aws.StringValue(eip.NetworkInterfaceId),
+        UpdateTime: time.Now(),
+    }
+    if eip.InstanceId != nil {
+        addr.ResourceType = ResourceInstance
+        addr.ResourceID = aws.StringValue(eip.InstanceId)
+    }
+    for _, tag := range eip.Tags {
+        if aws.StringValue(tag.Key) == "Name" {
+            addr.Name = aws.StringValue(tag.Value)
+        }
+    }
+    return addr
+}
@@ -0,0 +1,88 @@
+package aws
+
+import (
+    "context"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+const (
+    asgLifecycleInService = "InService"
+    asgHealthHealthy      = "Healthy"
+)
+
+type AutoScalingGroup struct {
+    Name            string
+    Source          string
+    Account         string
+    Region          string
+    MinSize         int64
+    MaxSize         int64
+    DesiredCapacity int64
+    Tags            map[string]string
+    Instances       []AutoScalingInstance
+    UpdateTime      time.Time
+}
+
+type AutoScalingInstance struct {
+    ID               string
+    AvailabilityZone string
+    LifecycleState   string
+    HealthStatus     string
+}
+
+// Healthy reports whether the member is in service and passing health
+// checks, i.e. should receive traffic.
+func (i AutoScalingInstance) Healthy() bool {
+    return i.LifecycleState == asgLifecycleInService && i.HealthStatus == asgHealthHealthy
+}
+
+func (s *EC2Source) listAutoScalingGroups(ctx context.Context) (error, []*AutoScalingGroup) {
+    account := s.Account(ctx)
+    groups := make([]*AutoScalingGroup, 0, 10)
+    err := s.retryThrottled(ctx, "describe auto scaling groups", func() error {
+        groups = groups[:0]
+        return s.autoscaling.DescribeAutoScalingGroupsPagesWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{},
+            func(page *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
+                for _, group := range page.AutoScalingGroups {
+                    groups = append(groups, newAutoScalingGroup(group))
+                }
+                return true
+            })
+    })
+    if err != nil {
+        return err, nil
+    }
+    for _, group := range groups {
+        group.Source = s.Name
+        group.Account = account
+        group.Region = s.Region
+    }
+    s.logger.Printf("%s: fetched %d auto scaling groups", s, len(groups))
+    return nil, groups
+}
+
+func newAutoScalingGroup(group *autoscaling.Group) *AutoScalingGroup {
+    asg := &AutoScalingGroup{
+        Name: aws.StringValue(group.AutoScalingGroupName),
+        MinSize: aws.Int64Value(group.MinSize),
+        MaxSize: aws.Int64Value(group.MaxSize),
+        DesiredCapacity: aws.Int64Value(group.DesiredCapacity),
+        Tags: make(map[string]string, len(group.Tags)),
+        UpdateTime: time.Now(),
+    }
+    for _, tag := range group.Tags {
+        asg.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+    }
+    for _, inst := range group.Instances {
+        asg.Instances = append(asg.Instances, AutoScalingInstance{
+            ID: aws.StringValue(inst.InstanceId),
+            AvailabilityZone: aws.StringValue(inst.AvailabilityZone),
+            LifecycleState: aws.StringValue(inst.LifecycleState),
+            HealthStatus: aws.StringValue(inst.HealthStatus),
+        })
+    }
+    return asg
+}
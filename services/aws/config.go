@@ -1,8 +1,100 @@
 package aws
 
+import (
+    "strings"
+)
+
 type Config struct {
-    AccessKeyID     string
-    SecretAccessKey string
-    Region          string
-    Ttl             int
+    AccessKeyID        string
+    SecretAccessKey    string
+    Region             string
+    Ttl                int
+    Inventory          string
+    InventoryFile      string
+    PageSize           int
+    MaxRetries         int
+    Credentials        string
+    Discover           string
+    InstanceStates     string
+    RefreshInterval    string
+    RefreshJitter      string
+    MaxBackoff         string
+    EventQueueURL      string
+    EventQueueRegion   string
+    EventQueueEndpoint string
+    SnapshotFile       string
+    SnapshotInterval   string
+    NameTemplate       []string
+    AliasTag           string
+    SRVTag             string
+    DuplicateNames     string
+    UniqueNames        string
+    Route53ZoneID      string
+    Route53Domain      string
+    Route53Endpoint    string
+    Route53Ttl         int
+    Route53Owner       string
+    Route53DryRun      bool
+    Sources            map[string]*SourceConfig
+}
+
+// SourceConfig describes one named inventory source, read from an
+// [AWSSource "name"] section. Region may be repeated to cover several
+// regions with the same credentials.
+type SourceConfig struct {
+    Inventory             string
+    InventoryFile         string
+    Region                []string
+    Account               string
+    Discover              string
+    Credentials           string
+    AccessKeyID           string
+    SecretAccessKey       string
+    Profile               string
+    SharedCredentialsFile string
+    WebIdentityTokenFile  string
+    WebIdentityRoleARN    string
+    RoleARN               string
+    RoleSessionName       string
+    ExternalID            string
+    SessionDuration       string
+}
+
+func (c *Config) sources() map[string]*SourceConfig {
+    if len(c.Sources) > 0 {
+        return c.Sources
+    }
+    return map[string]*SourceConfig{DefaultSource: c.defaultSource()}
+}
+
+// defaultSource is the source described by the [AWS] section itself.
+func (c *Config) defaultSource() *SourceConfig {
+    sc := &SourceConfig{
+        Credentials: c.Credentials,
+        Inventory: c.Inventory,
+        InventoryFile: c.InventoryFile,
+        AccessKeyID: c.AccessKeyID,
+        SecretAccessKey: c.SecretAccessKey,
+    }
+    if c.Region != "" {
+        sc.Region = []string{c.Region}
+    }
+    return sc
+}
+
+// discover returns the resource kinds to list besides EC2 instances, the
+// source's own Discover list overriding the one in [AWS].
+func (sc *SourceConfig) discover(c *Config) map[string]bool {
+    value := sc.Discover
+    if value == "" {
+        value = c.Discover
+    }
+    kinds := make(map[string]bool)
+    for _, kind := range strings.Split(value, ",") {
+        kind = strings.ToLower(strings.TrimSpace(kind))
+        if kind != "" {
+            kinds[kind] = true
+        }
+    }
+    return kinds
 }
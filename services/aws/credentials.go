@@ -0,0 +1,159 @@
+package aws
+
+import (
+    "fmt"
+    "os"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/aws/credentials"
+    "github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+    "github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+    "github.com/aws/aws-sdk-go/aws/ec2metadata"
+    "github.com/aws/aws-sdk-go/aws/session"
+    "github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+    CredentialsChain       = "chain"
+    CredentialsStatic      = "static"
+    CredentialsEnv         = "env"
+    CredentialsProfile     = "profile"
+    CredentialsInstance    = "instance"
+    CredentialsWebIdentity = "web-identity"
+
+    defaultRoleSessionName = "aws-meta-server"
+)
+
+// newSession builds the session a source uses in one region. The base
+// credentials come from the provider selected by SourceConfig.Credentials
+// and are optionally exchanged for an assumed role.
+func newSession(name string, region string, sc *SourceConfig) (error, *session.Session) {
+    awsConfig := aws.NewConfig().WithRegion(region)
+    base := session.New(awsConfig)
+    err, creds := newBaseCredentials(name, sc, base)
+    if err != nil {
+        return err, nil
+    }
+    sess := session.New(awsConfig.Copy().WithCredentials(creds))
+    if sc.RoleARN == "" {
+        return nil, sess
+    }
+    var duration time.Duration
+    if sc.SessionDuration != "" {
+        duration, err = time.ParseDuration(sc.SessionDuration)
+        if err != nil {
+            return fmt.Errorf("source %s: bad SessionDuration %q: %s", name, sc.SessionDuration, err.Error()), nil
+        }
+    }
+    roleCreds := stscreds.NewCredentials(sess, sc.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+        p.RoleSessionName = defaultRoleSessionName
+        if sc.RoleSessionName != "" {
+            p.RoleSessionName = sc.RoleSessionName
+        }
+        if sc.ExternalID != "" {
+            p.ExternalID = aws.String(sc.ExternalID)
+        }
+        if duration > 0 {
+            p.Duration = duration
+        }
+    })
+    return nil, session.New(awsConfig.Copy().WithCredentials(roleCreds))
+}
+
+func newBaseCredentials(name string, sc *SourceConfig, base *session.Session) (error, *credentials.Credentials) {
+    kind := sc.Credentials
+    if kind == "" {
+        if sc.AccessKeyID != "" {
+            kind = CredentialsStatic
+        } else {
+            kind = CredentialsChain
+        }
+    }
+    switch kind {
+    case CredentialsStatic:
+        if sc.AccessKeyID == "" || sc.SecretAccessKey == "" {
+            return fmt.Errorf("source %s: AccessKeyID and SecretAccessKey are required for %s credentials", name, kind), nil
+        }
+        return nil, credentials.NewStaticCredentials(sc.AccessKeyID, sc.SecretAccessKey, "")
+    case CredentialsEnv:
+        return nil, credentials.NewCredentials(&credentials.EnvProvider{})
+    case CredentialsProfile:
+        return nil, credentials.NewCredentials(sharedCredentialsProvider(sc))
+    case CredentialsInstance:
+        return nil, credentials.NewCredentials(instanceRoleProvider(base))
+    case CredentialsWebIdentity:
+        err, provider := webIdentityProvider(name, sc, base)
+        if err != nil {
+            return err, nil
+        }
+        return nil, credentials.NewCredentials(provider)
+    case CredentialsChain:
+        providers := []credentials.Provider{
+            &credentials.EnvProvider{},
+            sharedCredentialsProvider(sc),
+        }
+        if _, provider := webIdentityProvider(name, sc, base); provider != nil {
+            providers = append(providers, provider)
+        }
+        providers = append(providers, instanceRoleProvider(base))
+        return nil, credentials.NewCredentials(&credentials.ChainProvider{
+            VerboseErrors: true,
+            Providers: providers,
+        })
+    }
+    return fmt.Errorf("source %s: unknown credentials %q", name, kind), nil
+}
+
+func sharedCredentialsProvider(sc *SourceConfig) credentials.Provider {
+    return &credentials.SharedCredentialsProvider{
+        Filename: sc.SharedCredentialsFile,
+        Profile: sc.Profile,
+    }
+}
+
+func instanceRoleProvider(base *session.Session) credentials.Provider {
+    return &ec2rolecreds.EC2RoleProvider{
+        Client: ec2metadata.New(base),
+    }
+}
+
+// webIdentityProvider falls back to the AWS_WEB_IDENTITY_TOKEN_FILE and
+// AWS_ROLE_ARN variables set by EKS and similar platforms.
+func webIdentityProvider(name string, sc *SourceConfig, base *session.Session) (error, credentials.Provider) {
+    tokenFile := sc.WebIdentityTokenFile
+    if tokenFile == "" {
+        tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+    }
+    roleARN := sc.WebIdentityRoleARN
+    if roleARN == "" {
+        roleARN = os.Getenv("AWS_ROLE_ARN")
+    }
+    if tokenFile == "" || roleARN == "" {
+        return fmt.Errorf("source %s: WebIdentityTokenFile and WebIdentityRoleARN are required for %s credentials", name, CredentialsWebIdentity), nil
+    }
+    sessionName := sc.RoleSessionName
+    if sessionName == "" {
+        sessionName = defaultRoleSessionName
+    }
+    return nil, stscreds.NewWebIdentityRoleProvider(sts.New(base), roleARN, sessionName, tokenFile)
+}
+
+// credentialsError rewrites the SDK's missing and expired credential errors
+// into something that names the source at fault.
+func credentialsError(source fmt.Stringer, err error) error {
+    aerr, ok := err.(awserr.Error)
+    if !ok {
+        return err
+    }
+    switch aerr.Code() {
+    case "NoCredentialProviders":
+        return fmt.Errorf("%s: no AWS credentials found: %s", source, aerr.Message())
+    case "ExpiredToken", "ExpiredTokenException", "RequestExpired", "TokenRefreshRequired":
+        return fmt.Errorf("%s: AWS credentials expired: %s", source, aerr.Message())
+    case "InvalidClientTokenId", "UnrecognizedClientException", "AuthFailure", "SignatureDoesNotMatch":
+        return fmt.Errorf("%s: AWS credentials rejected: %s", source, aerr.Message())
+    }
+    return err
+}
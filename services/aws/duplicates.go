@@ -0,0 +1,102 @@
+package aws
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+)
+
+const (
+    DuplicatesAll    = "all"
+    DuplicatesNewest = "newest"
+    DuplicatesOldest = "oldest"
+    DuplicatesError  = "error"
+
+    UniqueNamesIndex = "index"
+    UniqueNamesID    = "id"
+)
+
+var (
+    DuplicateNameError = errors.New("name is shared by several instances")
+)
+
+// NameConflict lists the instances sharing a name, oldest first, with the
+// unique name each one can still be reached by and the IDs the duplicate
+// policy answers with.
+type NameConflict struct {
+    Name      string
+    Policy    string
+    Selected  []string
+    Instances []NameConflictMember
+}
+
+type NameConflictMember struct {
+    ID         string
+    UniqueName string
+    Source     string
+    Account    string
+    Region     string
+    LaunchTime time.Time
+}
+
+func parseDuplicatePolicy(c *Config, p *namingPolicy) error {
+    p.duplicates = DuplicatesAll
+    switch strings.ToLower(c.DuplicateNames) {
+    case "", DuplicatesAll:
+    case DuplicatesNewest, DuplicatesOldest, DuplicatesError:
+        p.duplicates = strings.ToLower(c.DuplicateNames)
+    default:
+        return fmt.Errorf("bad DuplicateNames %q", c.DuplicateNames)
+    }
+    for _, kind := range strings.Split(c.UniqueNames, ",") {
+        switch strings.ToLower(strings.TrimSpace(kind)) {
+        case "":
+        case UniqueNamesIndex:
+            p.uniqueIndex = true
+        case UniqueNamesID:
+            p.uniqueID = true
+        default:
+            return fmt.Errorf("bad UniqueNames %q", c.UniqueNames)
+        }
+    }
+    return nil
+}
+
+// selectDuplicates applies the duplicate policy to the instances found
+// under one name.
+func (p namingPolicy) selectDuplicates(instances []*EC2Instance) (error, []*EC2Instance) {
+    if len(instances) < 2 {
+        return nil, instances
+    }
+    switch p.duplicates {
+    case DuplicatesNewest:
+        sorted := sortByLaunchTime(instances)
+        return nil, sorted[len(sorted) - 1:]
+    case DuplicatesOldest:
+        return nil, sortByLaunchTime(instances)[:1]
+    case DuplicatesError:
+        return DuplicateNameError, nil
+    }
+    return nil, instances
+}
+
+// sortByLaunchTime returns a copy ordered oldest first, by ID when launched
+// at the same time, so the numbering of unique names is stable.
+func sortByLaunchTime(instances []*EC2Instance) []*EC2Instance {
+    sorted := make([]*EC2Instance, len(instances))
+    copy(sorted, instances)
+    sort.SliceStable(sorted, func(i, j int) bool {
+        if !sorted[i].LaunchTime.Equal(sorted[j].LaunchTime) {
+            return sorted[i].LaunchTime.Before(sorted[j].LaunchTime)
+        }
+        return sorted[i].ID < sorted[j].ID
+    })
+    return sorted
+}
+
+// uniqueIndexName is lower case like every lookup of byUnique.
+func uniqueIndexName(name string, n int) string {
+    return strings.ToLower(fmt.Sprintf("%s-%d", name, n))
+}
@@ -0,0 +1,308 @@
+package aws
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/request"
+    "github.com/aws/aws-sdk-go/aws/session"
+    "github.com/aws/aws-sdk-go/service/autoscaling"
+    "github.com/aws/aws-sdk-go/service/ec2"
+    "github.com/aws/aws-sdk-go/service/ecs"
+    "github.com/aws/aws-sdk-go/service/elb"
+    "github.com/aws/aws-sdk-go/service/elbv2"
+    "github.com/aws/aws-sdk-go/service/rds"
+    "github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+    defaultPageSize   = 500
+    minPageSize       = 5
+    maxPageSize       = 1000
+    defaultMaxRetries = 5
+    throttleBackoff   = 500 * time.Millisecond
+)
+
+type EC2Source struct {
+    Name          string
+    Region        string
+    client        *ec2.EC2
+    rds           *rds.RDS
+    elb           *elb.ELB
+    elbv2         *elbv2.ELBV2
+    autoscaling   *autoscaling.AutoScaling
+    ecs           *ecs.ECS
+    sts           *sts.STS
+    logger        *log.Logger
+    pageSize      int64
+    maxRetries    int
+    discover      map[string]bool
+    accountMu     sync.Mutex
+    account       string
+    resourcesMu   sync.Mutex
+    lastResources *Resources
+}
+
+func NewEC2Source(name string, region string, sess *session.Session, sc *SourceConfig, c *Config) *EC2Source {
+    pageSize := c.PageSize
+    if pageSize <= 0 {
+        pageSize = defaultPageSize
+    } else if pageSize < minPageSize {
+        pageSize = minPageSize
+    } else if pageSize > maxPageSize {
+        pageSize = maxPageSize
+    }
+    maxRetries := c.MaxRetries
+    if maxRetries <= 0 {
+        maxRetries = defaultMaxRetries
+    }
+    return &EC2Source{
+        Name: name,
+        Region: region,
+        client: ec2.New(sess),
+        rds: rds.New(sess),
+        elb: elb.New(sess),
+        elbv2: elbv2.New(sess),
+        autoscaling: autoscaling.New(sess),
+        ecs: ecs.New(sess),
+        sts: sts.New(sess),
+        logger: log.New(os.Stderr, "[aws] ", log.LstdFlags),
+        pageSize: int64(pageSize),
+        maxRetries: maxRetries,
+        discover: sc.discover(c),
+        account: sc.Account,
+    }
+}
+
+func (s *EC2Source) String() string {
+    return fmt.Sprintf("%s/%s", s.Name, s.Region)
+}
+
+// Account returns the account ID the source's credentials belong to, asking
+// STS the first time if it was not configured.
+func (s *EC2Source) Account(ctx context.Context) string {
+    s.accountMu.Lock()
+    defer s.accountMu.Unlock()
+    if s.account != "" {
+        return s.account
+    }
+    resp, err := s.sts.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+    if err != nil {
+        s.logger.Printf("%s: get caller identity failed: %s", s, credentialsError(s, err).Error())
+        return ""
+    }
+    s.account = aws.StringValue(resp.Account)
+    return s.account
+}
+
+func (s *EC2Source) ListInstances(ctx context.Context) (error, []*EC2Instance) {
+    account := s.Account(ctx)
+    instances := make([]*EC2Instance, 0, 10)
+    input := &ec2.DescribeInstancesInput{
+        MaxResults: aws.Int64(s.pageSize),
+    }
+    pages := 0
+    for {
+        err, resp := s.describeInstances(ctx, input)
+        if err != nil {
+            return err, nil
+        }
+        pages += 1
+        for _, rev := range resp.Reservations {
+            for _, inst := range rev.Instances {
+                instance := newEC2(inst)
+                instance.Source = s.Name
+                instance.Account = account
+                instance.Region = s.Region
+                instances = append(instances, instance)
+            }
+        }
+        if resp.NextToken == nil || *resp.NextToken == "" {
+            break
+        }
+        input.NextToken = resp.NextToken
+    }
+    s.logger.Printf("%s: fetched %d ec2 instances in %d pages", s, len(instances), pages)
+    return nil, instances
+}
+
+func (s *EC2Source) LookupInstance(ctx context.Context, account string, region string, id string) (error, *EC2Instance) {
+    if region != "" && region != s.Region {
+        return errNotInSource, nil
+    }
+    ownAccount := s.Account(ctx)
+    if account != "" && ownAccount != "" && account != ownAccount {
+        return errNotInSource, nil
+    }
+    resp, err := s.client.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+        InstanceIds: []*string{aws.String(id)},
+    })
+    if err != nil {
+        return credentialsError(s, err), nil
+    }
+    for _, rev := range resp.Reservations {
+        for _, inst := range rev.Instances {
+            instance := newEC2(inst)
+            instance.Source = s.Name
+            instance.Account = ownAccount
+            instance.Region = s.Region
+            return nil, instance
+        }
+    }
+    return notFoundError, nil
+}
+
+// ListResources lists everything other than instances that the source is
+// configured to discover. A kind that fails keeps its previous listing so
+// one missing permission or throttled API does not drop the others, the
+// listing only fails when every kind does.
+func (s *EC2Source) ListResources(ctx context.Context) (error, *Resources) {
+    s.resourcesMu.Lock()
+    defer s.resourcesMu.Unlock()
+    previous := s.lastResources
+    if previous == nil {
+        previous = &Resources{}
+    }
+    resources := &Resources{}
+    attempted, failed := 0, 0
+    var lastErr error
+    list := func(kind string, listFunc func() error, keepPrevious func()) {
+        if !s.discover[kind] {
+            return
+        }
+        attempted += 1
+        if err := listFunc(); err != nil {
+            failed += 1
+            lastErr = err
+            s.logger.Printf("%s: list %s failed, keeping previous result: %s", s, kind, err.Error())
+            keepPrevious()
+        }
+    }
+    list(DiscoverRDS, func() (err error) {
+        err, resources.Databases = s.listDatabases(ctx)
+        return err
+    }, func() { resources.Databases = previous.Databases })
+    list(DiscoverELB, func() (err error) {
+        err, resources.LoadBalancers = s.listLoadBalancers(ctx)
+        return err
+    }, func() { resources.LoadBalancers = previous.LoadBalancers })
+    list(DiscoverASG, func() (err error) {
+        err, resources.AutoScalingGroups = s.listAutoScalingGroups(ctx)
+        return err
+    }, func() { resources.AutoScalingGroups = previous.AutoScalingGroups })
+    list(DiscoverECS, func() (err error) {
+        err, resources.ECSClusters, resources.ECSTasks = s.listECS(ctx)
+        return err
+    }, func() {
+        resources.ECSClusters = previous.ECSClusters
+        resources.ECSTasks = previous.ECSTasks
+    })
+    list(DiscoverENI, func() (err error) {
+        err, resources.Addresses = s.listAddresses(ctx)
+        return err
+    }, func() { resources.Addresses = previous.Addresses })
+    list(DiscoverVPC, func() (err error) {
+        err, resources.VPCs = s.listVPCs(ctx)
+        return err
+    }, func() { resources.VPCs = previous.VPCs })
+    if attempted > 0 && failed == attempted {
+        return lastErr, nil
+    }
+    s.lastResources = resources
+    return nil, resources
+}
+
+// describeInstances fetches a single page, backing off and retrying while
+// the API reports throttling.
+func (s *EC2Source) describeInstances(ctx context.Context, input *ec2.DescribeInstancesInput) (error, *ec2.DescribeInstancesOutput) {
+    var resp *ec2.DescribeInstancesOutput
+    err := s.retryThrottled(ctx, "describe instances", func() error {
+        var err error
+        resp, err = s.client.DescribeInstancesWithContext(ctx, input)
+        return err
+    })
+    return err, resp
+}
+
+// retryThrottled calls fn until it succeeds, fails with anything but
+// throttling, or runs out of retries, doubling the wait in between.
+func (s *EC2Source) retryThrottled(ctx context.Context, what string, fn func() error) error {
+    backoff := throttleBackoff
+    for attempt := 0; ; attempt++ {
+        err := fn()
+        if err == nil {
+            return nil
+        }
+        if !request.IsErrorThrottle(err) || attempt >= s.maxRetries {
+            return credentialsError(s, err)
+        }
+        s.logger.Printf("%s: %s throttled, retrying in %s", s, what, backoff)
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(backoff):
+        }
+        backoff *= 2
+    }
+}
+
+func newEC2(inst *ec2.Instance) *EC2Instance {
+    ec2 := &EC2Instance{
+        ID: aws.StringValue(inst.InstanceId),
+        InstanceType: aws.StringValue(inst.InstanceType),
+        VpcID: aws.StringValue(inst.VpcId),
+        SubnetID: aws.StringValue(inst.SubnetId),
+        LaunchTime: aws.TimeValue(inst.LaunchTime),
+        Tags: make(map[string]string, len(inst.Tags)),
+    }
+    for _, tag := range inst.Tags {
+        if tag.Key != nil {
+            ec2.Tags[*tag.Key] = aws.StringValue(tag.Value)
+        }
+    }
+    ec2.Name = ec2.Tags["Name"]
+    if inst.State != nil {
+        ec2.State = aws.StringValue(inst.State.Name)
+    }
+    if inst.Placement != nil {
+        ec2.AvailabilityZone = aws.StringValue(inst.Placement.AvailabilityZone)
+    }
+    for _, group := range inst.SecurityGroups {
+        ec2.SecurityGroups = append(ec2.SecurityGroups, aws.StringValue(group.GroupId))
+    }
+    if inst.PublicDnsName != nil {
+        ec2.PublicDNS = *inst.PublicDnsName
+        ec2.Address = ec2.PublicDNS
+    }
+    if inst.PublicIpAddress != nil {
+        ec2.PublicIP = *inst.PublicIpAddress
+    }
+    if inst.PrivateDnsName != nil {
+        ec2.PrivateDNS = *inst.PrivateDnsName
+        if ec2.Address == "" {
+            ec2.Address = ec2.PrivateDNS
+        }
+    }
+    if inst.PrivateIpAddress != nil {
+        ec2.PrivateIP = *inst.PrivateIpAddress
+    }
+    for _, eni := range inst.NetworkInterfaces {
+        for _, addr := range eni.PrivateIpAddresses {
+            if addr.PrivateIpAddress != nil {
+                ec2.PrivateIPs = append(ec2.PrivateIPs, *addr.PrivateIpAddress)
+            }
+        }
+        for _, addr := range eni.Ipv6Addresses {
+            if addr.Ipv6Address != nil {
+                ec2.IPv6Addresses = append(ec2.IPv6Addresses, *addr.Ipv6Address)
+            }
+        }
+    }
+    ec2.UpdateTime = time.Now()
+    return ec2
+}
@@ -0,0 +1,102 @@
+package aws
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+
+    "github.com/aws/aws-sdk-go/aws"
+)
+
+// fakePages is a local stand-in for EC2 DescribeInstances that serves one
+// instance per page and answers the first throttled requests with
+// RequestLimitExceeded.
+type fakePages struct {
+    mu        sync.Mutex
+    pages     int
+    throttled int
+    requests  []string
+}
+
+func (f *fakePages) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    r.ParseForm()
+    token := r.Form.Get("NextToken")
+    f.requests = append(f.requests, r.Form.Get("Action") + ":" + r.Form.Get("MaxResults") + ":" + token)
+    w.Header().Set("Content-Type", "text/xml")
+    if f.throttled > 0 {
+        f.throttled -= 1
+        w.WriteHeader(400)
+        w.Write([]byte(`<Response><Errors><Error><Code>RequestLimitExceeded</Code><Message>Request limit exceeded.</Message></Error></Errors><RequestID>1</RequestID></Response>`))
+        return
+    }
+    page := 1
+    if token != "" {
+        fmt.Sscanf(token, "page-%d", &page)
+    }
+    next := ""
+    if page < f.pages {
+        next = fmt.Sprintf("<nextToken>page-%d</nextToken>", page + 1)
+    }
+    fmt.Fprintf(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet><item>
+        <instanceId>i-%d</instanceId><privateIpAddress>10.0.0.%d</privateIpAddress><instanceState><name>running</name></instanceState>
+        <tagSet><item><key>Name</key><value>web-%d</value></item></tagSet>
+        </item></instancesSet></item></reservationSet>%s</DescribeInstancesResponse>`, page, page, page, next)
+}
+
+func newFakeEC2Source(t *testing.T, handler http.Handler, c *Config) *EC2Source {
+    server := httptest.NewServer(handler)
+    t.Cleanup(server.Close)
+    sc := &SourceConfig{Account: "123456789012", AccessKeyID: "test", SecretAccessKey: "test"}
+    err, sess := newSession("test", "us-east-1", sc)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sess.Config.Endpoint = aws.String(server.URL)
+    // Leave throttling to retryThrottled rather than the SDK's own retries.
+    sess.Config.MaxRetries = aws.Int(0)
+    return NewEC2Source("test", "us-east-1", sess, sc, c)
+}
+
+func TestListInstancesPagesAndRetriesThrottling(t *testing.T) {
+    fake := &fakePages{pages: 3, throttled: 1}
+    source := newFakeEC2Source(t, fake, &Config{PageSize: 10})
+
+    err, instances := source.ListInstances(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    var names []string
+    for _, inst := range instances {
+        names = append(names, inst.ID + "=" + inst.Name + "@" + inst.PrivateIP)
+        if inst.Source != "test" || inst.Account != "123456789012" || inst.Region != "us-east-1" {
+            t.Errorf("%s: source %q, account %q, region %q", inst.ID, inst.Source, inst.Account, inst.Region)
+        }
+    }
+    if strings.Join(names, ",") != "i-1=web-1@10.0.0.1,i-2=web-2@10.0.0.2,i-3=web-3@10.0.0.3" {
+        t.Errorf("instances: %v", names)
+    }
+    // The throttled first page is asked for again before moving on.
+    want := "DescribeInstances:10:,DescribeInstances:10:,DescribeInstances:10:page-2,DescribeInstances:10:page-3"
+    if requests := strings.Join(fake.requests, ","); requests != want {
+        t.Errorf("requests: %s, want %s", requests, want)
+    }
+}
+
+func TestListInstancesGivesUpAfterMaxRetries(t *testing.T) {
+    fake := &fakePages{pages: 1, throttled: 100}
+    source := newFakeEC2Source(t, fake, &Config{MaxRetries: 1})
+
+    err, _ := source.ListInstances(context.Background())
+    if err == nil || !strings.Contains(err.Error(), "RequestLimitExceeded") {
+        t.Errorf("listing while throttled: %v", err)
+    }
+    if len(fake.requests) != 2 {
+        t.Errorf("%d requests, want 2: %v", len(fake.requests), fake.requests)
+    }
+}
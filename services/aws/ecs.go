@@ -0,0 +1,274 @@
+package aws
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const (
+    ecsDescribeServicesBatch = 10
+    ecsDescribeTasksBatch    = 100
+    ecsServiceGroupPrefix    = "service:"
+    ecsENIAttachment         = "ElasticNetworkInterface"
+    ecsENIPrivateIPv4        = "privateIPv4Address"
+)
+
+type ECSCluster struct {
+    Name       string
+    ARN        string
+    Source     string
+    Account    string
+    Region     string
+    Services   []ECSService
+    UpdateTime time.Time
+}
+
+type ECSService struct {
+    Name         string
+    ARN          string
+    Status       string
+    DesiredCount int64
+    RunningCount int64
+}
+
+// ECSTask is a running task. IPs are the private addresses of its awsvpc
+// ENIs, tasks using bridge or host networking have none.
+type ECSTask struct {
+    ID               string
+    ARN              string
+    Cluster          string
+    Service          string
+    TaskDefinition   string
+    LastStatus       string
+    HealthStatus     string
+    AvailabilityZone string
+    Source           string
+    Account          string
+    Region           string
+    IPs              []string
+    Ports            []ECSPort
+    UpdateTime       time.Time
+}
+
+type ECSPort struct {
+    Name      string
+    Container string
+    Port      int64
+    Protocol  string
+}
+
+func (s *EC2Source) listECS(ctx context.Context) (error, []*ECSCluster, []*ECSTask) {
+    clusterARNs := make([]*string, 0, 10)
+    err := s.retryThrottled(ctx, "list ecs clusters", func() error {
+        clusterARNs = clusterARNs[:0]
+        return s.ecs.ListClustersPagesWithContext(ctx, &ecs.ListClustersInput{},
+            func(page *ecs.ListClustersOutput, lastPage bool) bool {
+                clusterARNs = append(clusterARNs, page.ClusterArns...)
+                return true
+            })
+    })
+    if err != nil {
+        return err, nil, nil
+    }
+    account := s.Account(ctx)
+    clusters := make([]*ECSCluster, 0, len(clusterARNs))
+    tasks := make([]*ECSTask, 0, 10)
+    taskDefinitions := make(map[string]*ecs.TaskDefinition)
+    for _, arn := range clusterARNs {
+        cluster := &ECSCluster{
+            Name: arnResourceName(aws.StringValue(arn)),
+            ARN: aws.StringValue(arn),
+            Source: s.Name,
+            Account: account,
+            Region: s.Region,
+            UpdateTime: time.Now(),
+        }
+        err, services := s.listECSServices(ctx, cluster.ARN)
+        if err != nil {
+            return err, nil, nil
+        }
+        cluster.Services = services
+        clusters = append(clusters, cluster)
+
+        err, clusterTasks := s.listECSTasks(ctx, cluster, taskDefinitions)
+        if err != nil {
+            return err, nil, nil
+        }
+        tasks = append(tasks, clusterTasks...)
+    }
+    s.logger.Printf("%s: fetched %d ecs clusters and %d tasks", s, len(clusters), len(tasks))
+    return nil, clusters, tasks
+}
+
+func (s *EC2Source) listECSServices(ctx context.Context, clusterARN string) (error, []ECSService) {
+    serviceARNs := make([]*string, 0, 10)
+    err := s.retryThrottled(ctx, "list ecs services", func() error {
+        serviceARNs = serviceARNs[:0]
+        return s.ecs.ListServicesPagesWithContext(ctx, &ecs.ListServicesInput{
+            Cluster: aws.String(clusterARN),
+        }, func(page *ecs.ListServicesOutput, lastPage bool) bool {
+            serviceARNs = append(serviceARNs, page.ServiceArns...)
+            return true
+        })
+    })
+    if err != nil {
+        return err, nil
+    }
+    services := make([]ECSService, 0, len(serviceARNs))
+    for start := 0; start < len(serviceARNs); start += ecsDescribeServicesBatch {
+        end := start + ecsDescribeServicesBatch
+        if end > len(serviceARNs) {
+            end = len(serviceARNs)
+        }
+        var resp *ecs.DescribeServicesOutput
+        err := s.retryThrottled(ctx, "describe ecs services", func() error {
+            var err error
+            resp, err = s.ecs.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{
+                Cluster: aws.String(clusterARN),
+                Services: serviceARNs[start:end],
+            })
+            return err
+        })
+        if err != nil {
+            return err, nil
+        }
+        for _, svc := range resp.Services {
+            services = append(services, ECSService{
+                Name: aws.StringValue(svc.ServiceName),
+                ARN: aws.StringValue(svc.ServiceArn),
+                Status: aws.StringValue(svc.Status),
+                DesiredCount: aws.Int64Value(svc.DesiredCount),
+                RunningCount: aws.Int64Value(svc.RunningCount),
+            })
+        }
+    }
+    return nil, services
+}
+
+func (s *EC2Source) listECSTasks(ctx context.Context, cluster *ECSCluster, taskDefinitions map[string]*ecs.TaskDefinition) (error, []*ECSTask) {
+    taskARNs := make([]*string, 0, 10)
+    err := s.retryThrottled(ctx, "list ecs tasks", func() error {
+        taskARNs = taskARNs[:0]
+        return s.ecs.ListTasksPagesWithContext(ctx, &ecs.ListTasksInput{
+            Cluster: aws.String(cluster.ARN),
+            DesiredStatus: aws.String(ecs.DesiredStatusRunning),
+        }, func(page *ecs.ListTasksOutput, lastPage bool) bool {
+            taskARNs = append(taskARNs, page.TaskArns...)
+            return true
+        })
+    })
+    if err != nil {
+        return err, nil
+    }
+    tasks := make([]*ECSTask, 0, len(taskARNs))
+    for start := 0; start < len(taskARNs); start += ecsDescribeTasksBatch {
+        end := start + ecsDescribeTasksBatch
+        if end > len(taskARNs) {
+            end = len(taskARNs)
+        }
+        var resp *ecs.DescribeTasksOutput
+        err := s.retryThrottled(ctx, "describe ecs tasks", func() error {
+            var err error
+            resp, err = s.ecs.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+                Cluster: aws.String(cluster.ARN),
+                Tasks: taskARNs[start:end],
+            })
+            return err
+        })
+        if err != nil {
+            return err, nil
+        }
+        for _, t := range resp.Tasks {
+            err, def := s.describeTaskDefinition(ctx, aws.StringValue(t.TaskDefinitionArn), taskDefinitions)
+            if err != nil {
+                return err, nil
+            }
+            task := newECSTask(t, def)
+            task.Cluster = cluster.Name
+            task.Source = cluster.Source
+            task.Account = cluster.Account
+            task.Region = cluster.Region
+            tasks = append(tasks, task)
+        }
+    }
+    return nil, tasks
+}
+
+// describeTaskDefinition looks up the port mappings of a task definition,
+// caching them for the rest of the refresh since many tasks share one.
+func (s *EC2Source) describeTaskDefinition(ctx context.Context, arn string, cache map[string]*ecs.TaskDefinition) (error, *ecs.TaskDefinition) {
+    if def, ok := cache[arn]; ok {
+        return nil, def
+    }
+    var resp *ecs.DescribeTaskDefinitionOutput
+    err := s.retryThrottled(ctx, "describe ecs task definition", func() error {
+        var err error
+        resp, err = s.ecs.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{
+            TaskDefinition: aws.String(arn),
+        })
+        return err
+    })
+    if err != nil {
+        return err, nil
+    }
+    cache[arn] = resp.TaskDefinition
+    return nil, resp.TaskDefinition
+}
+
+func newECSTask(t *ecs.Task, def *ecs.TaskDefinition) *ECSTask {
+    task := &ECSTask{
+        ARN: aws.StringValue(t.TaskArn),
+        TaskDefinition: aws.StringValue(t.TaskDefinitionArn),
+        LastStatus: aws.StringValue(t.LastStatus),
+        HealthStatus: aws.StringValue(t.HealthStatus),
+        AvailabilityZone: aws.StringValue(t.AvailabilityZone),
+        UpdateTime: time.Now(),
+    }
+    task.ID = arnResourceName(task.ARN)
+    group := aws.StringValue(t.Group)
+    if strings.HasPrefix(group, ecsServiceGroupPrefix) {
+        task.Service = strings.TrimPrefix(group, ecsServiceGroupPrefix)
+    }
+    for _, attachment := range t.Attachments {
+        if aws.StringValue(attachment.Type) != ecsENIAttachment {
+            continue
+        }
+        for _, detail := range attachment.Details {
+            if aws.StringValue(detail.Name) == ecsENIPrivateIPv4 {
+                task.IPs = append(task.IPs, aws.StringValue(detail.Value))
+            }
+        }
+    }
+    if def == nil {
+        return task
+    }
+    for _, container := range def.ContainerDefinitions {
+        for _, mapping := range container.PortMappings {
+            port := ECSPort{
+                Name: aws.StringValue(mapping.Name),
+                Container: aws.StringValue(container.Name),
+                Port: aws.Int64Value(mapping.ContainerPort),
+                Protocol: aws.StringValue(mapping.Protocol),
+            }
+            if port.Name == "" {
+                port.Name = fmt.Sprintf("%s-%d", port.Container, port.Port)
+            }
+            if port.Protocol == "" {
+                port.Protocol = ecs.TransportProtocolTcp
+            }
+            task.Ports = append(task.Ports, port)
+        }
+    }
+    return task
+}
+
+// arnResourceName returns the last path element of an ARN such as
+// arn:aws:ecs:us-east-1:123456789012:cluster/prod.
+func arnResourceName(arn string) string {
+    return arn[strings.LastIndex(arn, "/") + 1:]
+}
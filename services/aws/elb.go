@@ -0,0 +1,249 @@
+package aws
+
+import (
+    "context"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/elb"
+    "github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+const (
+    LoadBalancerClassic = "classic"
+
+    // DescribeTags accepts at most 20 load balancers per call.
+    elbTagBatch = 20
+)
+
+// LoadBalancer is a classic, application, network or gateway load
+// balancer together with the health of its targets.
+type LoadBalancer struct {
+    Name       string
+    ARN        string
+    Type       string
+    Scheme     string
+    State      string
+    DNSName    string
+    VpcID      string
+    Source     string
+    Account    string
+    Region     string
+    Tags       map[string]string
+    Targets    []LoadBalancerTarget
+    UpdateTime time.Time
+}
+
+type LoadBalancerTarget struct {
+    TargetGroup string
+    ID          string
+    Port        int64
+    State       string
+    Reason      string
+}
+
+func (s *EC2Source) listLoadBalancers(ctx context.Context) (error, []*LoadBalancer) {
+    err, classic := s.listClassicLoadBalancers(ctx)
+    if err != nil {
+        return err, nil
+    }
+    err, v2 := s.listV2LoadBalancers(ctx)
+    if err != nil {
+        return err, nil
+    }
+    account := s.Account(ctx)
+    lbs := append(classic, v2...)
+    for _, lb := range lbs {
+        lb.Source = s.Name
+        lb.Account = account
+        lb.Region = s.Region
+    }
+    s.logger.Printf("%s: fetched %d classic and %d v2 load balancers", s, len(classic), len(v2))
+    return nil, lbs
+}
+
+func (s *EC2Source) listClassicLoadBalancers(ctx context.Context) (error, []*LoadBalancer) {
+    lbs := make([]*LoadBalancer, 0, 10)
+    err := s.retryThrottled(ctx, "describe classic load balancers", func() error {
+        lbs = lbs[:0]
+        return s.elb.DescribeLoadBalancersPagesWithContext(ctx, &elb.DescribeLoadBalancersInput{},
+            func(page *elb.DescribeLoadBalancersOutput, lastPage bool) bool {
+                for _, desc := range page.LoadBalancerDescriptions {
+                    lbs = append(lbs, &LoadBalancer{
+                        Name: aws.StringValue(desc.LoadBalancerName),
+                        Type: LoadBalancerClassic,
+                        Scheme: aws.StringValue(desc.Scheme),
+                        DNSName: aws.StringValue(desc.DNSName),
+                        VpcID: aws.StringValue(desc.VPCId),
+                        Tags: make(map[string]string),
+                        UpdateTime: time.Now(),
+                    })
+                }
+                return true
+            })
+    })
+    if err != nil {
+        return err, nil
+    }
+    byName := make(map[string]*LoadBalancer, len(lbs))
+    names := make([]*string, 0, len(lbs))
+    for _, lb := range lbs {
+        byName[lb.Name] = lb
+        names = append(names, aws.String(lb.Name))
+    }
+    for start := 0; start < len(names); start += elbTagBatch {
+        end := start + elbTagBatch
+        if end > len(names) {
+            end = len(names)
+        }
+        var resp *elb.DescribeTagsOutput
+        err := s.retryThrottled(ctx, "describe classic load balancer tags", func() error {
+            var err error
+            resp, err = s.elb.DescribeTagsWithContext(ctx, &elb.DescribeTagsInput{
+                LoadBalancerNames: names[start:end],
+            })
+            return err
+        })
+        if err != nil {
+            return err, nil
+        }
+        for _, desc := range resp.TagDescriptions {
+            if lb, ok := byName[aws.StringValue(desc.LoadBalancerName)]; ok {
+                for _, tag := range desc.Tags {
+                    lb.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+                }
+            }
+        }
+    }
+    for _, lb := range lbs {
+        var resp *elb.DescribeInstanceHealthOutput
+        err := s.retryThrottled(ctx, "describe instance health", func() error {
+            var err error
+            resp, err = s.elb.DescribeInstanceHealthWithContext(ctx, &elb.DescribeInstanceHealthInput{
+                LoadBalancerName: aws.String(lb.Name),
+            })
+            return err
+        })
+        if err != nil {
+            return err, nil
+        }
+        for _, state := range resp.InstanceStates {
+            lb.Targets = append(lb.Targets, LoadBalancerTarget{
+                ID: aws.StringValue(state.InstanceId),
+                State: aws.StringValue(state.State),
+                Reason: aws.StringValue(state.ReasonCode),
+            })
+        }
+    }
+    return nil, lbs
+}
+
+func (s *EC2Source) listV2LoadBalancers(ctx context.Context) (error, []*LoadBalancer) {
+    lbs := make([]*LoadBalancer, 0, 10)
+    err := s.retryThrottled(ctx, "describe load balancers", func() error {
+        lbs = lbs[:0]
+        return s.elbv2.DescribeLoadBalancersPagesWithContext(ctx, &elbv2.DescribeLoadBalancersInput{},
+            func(page *elbv2.DescribeLoadBalancersOutput, lastPage bool) bool {
+                for _, desc := range page.LoadBalancers {
+                    lb := &LoadBalancer{
+                        Name: aws.StringValue(desc.LoadBalancerName),
+                        ARN: aws.StringValue(desc.LoadBalancerArn),
+                        Type: aws.StringValue(desc.Type),
+                        Scheme: aws.StringValue(desc.Scheme),
+                        DNSName: aws.StringValue(desc.DNSName),
+                        VpcID: aws.StringValue(desc.VpcId),
+                        Tags: make(map[string]string),
+                        UpdateTime: time.Now(),
+                    }
+                    if desc.State != nil {
+                        lb.State = aws.StringValue(desc.State.Code)
+                    }
+                    lbs = append(lbs, lb)
+                }
+                return true
+            })
+    })
+    if err != nil {
+        return err, nil
+    }
+    byARN := make(map[string]*LoadBalancer, len(lbs))
+    arns := make([]*string, 0, len(lbs))
+    for _, lb := range lbs {
+        byARN[lb.ARN] = lb
+        arns = append(arns, aws.String(lb.ARN))
+    }
+    for start := 0; start < len(arns); start += elbTagBatch {
+        end := start + elbTagBatch
+        if end > len(arns) {
+            end = len(arns)
+        }
+        var resp *elbv2.DescribeTagsOutput
+        err := s.retryThrottled(ctx, "describe load balancer tags", func() error {
+            var err error
+            resp, err = s.elbv2.DescribeTagsWithContext(ctx, &elbv2.DescribeTagsInput{
+                ResourceArns: arns[start:end],
+            })
+            return err
+        })
+        if err != nil {
+            return err, nil
+        }
+        for _, desc := range resp.TagDescriptions {
+            if lb, ok := byARN[aws.StringValue(desc.ResourceArn)]; ok {
+                for _, tag := range desc.Tags {
+                    lb.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+                }
+            }
+        }
+    }
+    for _, lb := range lbs {
+        if err := s.listTargetHealth(ctx, lb); err != nil {
+            return err, nil
+        }
+    }
+    return nil, lbs
+}
+
+func (s *EC2Source) listTargetHealth(ctx context.Context, lb *LoadBalancer) error {
+    groups := make([]*elbv2.TargetGroup, 0, 4)
+    err := s.retryThrottled(ctx, "describe target groups", func() error {
+        groups = groups[:0]
+        return s.elbv2.DescribeTargetGroupsPagesWithContext(ctx, &elbv2.DescribeTargetGroupsInput{
+            LoadBalancerArn: aws.String(lb.ARN),
+        }, func(page *elbv2.DescribeTargetGroupsOutput, lastPage bool) bool {
+            groups = append(groups, page.TargetGroups...)
+            return true
+        })
+    })
+    if err != nil {
+        return err
+    }
+    for _, group := range groups {
+        var resp *elbv2.DescribeTargetHealthOutput
+        err := s.retryThrottled(ctx, "describe target health", func() error {
+            var err error
+            resp, err = s.elbv2.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+                TargetGroupArn: group.TargetGroupArn,
+            })
+            return err
+        })
+        if err != nil {
+            return err
+        }
+        for _, desc := range resp.TargetHealthDescriptions {
+            target := LoadBalancerTarget{
+                TargetGroup: aws.StringValue(group.TargetGroupName),
+            }
+            if desc.Target != nil {
+                target.ID = aws.StringValue(desc.Target.Id)
+                target.Port = aws.Int64Value(desc.Target.Port)
+            }
+            if desc.TargetHealth != nil {
+                target.State = aws.StringValue(desc.TargetHealth.State)
+                target.Reason = aws.StringValue(desc.TargetHealth.Reason)
+            }
+            lb.Targets = append(lb.Targets, target)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,137 @@
+package aws
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+    eventPollWait    = 20
+    eventPollBatch   = 10
+    eventPollBackoff = 5 * time.Second
+)
+
+// EventPoller long-polls an SQS queue fed by EventBridge with EC2 state
+// changes and applies them to the service cache. EventQueueEndpoint points
+// it at a local SQS-compatible server.
+type EventPoller struct {
+    QueueURL string
+    client   *sqs.SQS
+    service  *Service
+    logger   *log.Logger
+    cancel   context.CancelFunc
+    done     chan struct{}
+}
+
+func NewEventPoller(c *Config, service *Service) (error, *EventPoller) {
+    region := c.EventQueueRegion
+    if region == "" {
+        region = c.Region
+    }
+    if region == "" {
+        region = queueRegion(c.EventQueueURL)
+    }
+    if region == "" {
+        return fmt.Errorf("EventQueueRegion is required when [AWS] Region is not set and EventQueueURL names no region"), nil
+    }
+    err, sess := newSession("events", region, c.defaultSource())
+    if err != nil {
+        return err, nil
+    }
+    clientConfig := aws.NewConfig()
+    if c.EventQueueEndpoint != "" {
+        clientConfig = clientConfig.WithEndpoint(c.EventQueueEndpoint)
+    }
+    return nil, &EventPoller{
+        QueueURL: c.EventQueueURL,
+        client: sqs.New(sess, clientConfig),
+        service: service,
+        logger: log.New(os.Stderr, "[aws] ", log.LstdFlags),
+    }
+}
+
+// queueRegion reads the region out of a queue URL such as
+// https://sqs.us-east-1.amazonaws.com/123456789012/events.
+func queueRegion(queueURL string) string {
+    parsed, err := url.Parse(queueURL)
+    if err != nil {
+        return ""
+    }
+    labels := strings.Split(parsed.Hostname(), ".")
+    if len(labels) < 4 || labels[0] != "sqs" {
+        return ""
+    }
+    return labels[1]
+}
+
+func (p *EventPoller) Start() {
+    ctx, cancel := context.WithCancel(context.Background())
+    p.cancel = cancel
+    p.done = make(chan struct{})
+    go p.poll(ctx)
+}
+
+func (p *EventPoller) Stop() {
+    if p.cancel == nil {
+        return
+    }
+    p.cancel()
+    <-p.done
+    p.cancel = nil
+}
+
+func (p *EventPoller) poll(ctx context.Context) {
+    defer close(p.done)
+    for ctx.Err() == nil {
+        resp, err := p.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+            QueueUrl: aws.String(p.QueueURL),
+            MaxNumberOfMessages: aws.Int64(eventPollBatch),
+            WaitTimeSeconds: aws.Int64(eventPollWait),
+        })
+        if err != nil {
+            if ctx.Err() != nil {
+                return
+            }
+            p.logger.Printf("receive events failed: %s", credentialsError(p, err).Error())
+            select {
+            case <-ctx.Done():
+                return
+            case <-time.After(eventPollBackoff):
+            }
+            continue
+        }
+        for _, msg := range resp.Messages {
+            p.handle(ctx, msg)
+        }
+    }
+}
+
+// handle applies one message and deletes it from the queue. Messages that
+// are not instance state changes are deleted too so they do not come back.
+func (p *EventPoller) handle(ctx context.Context, msg *sqs.Message) {
+    err, event := ParseInstanceStateEvent([]byte(aws.StringValue(msg.Body)))
+    if err != nil {
+        p.logger.Printf("dropping event %s: %s", aws.StringValue(msg.MessageId), err.Error())
+    } else if err := p.service.ApplyInstanceStateEvent(ctx, event); err != nil {
+        p.logger.Printf("apply event %s failed: %s", aws.StringValue(msg.MessageId), err.Error())
+    }
+    _, err = p.client.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+        QueueUrl: aws.String(p.QueueURL),
+        ReceiptHandle: msg.ReceiptHandle,
+    })
+    if err != nil && ctx.Err() == nil {
+        p.logger.Printf("delete event %s failed: %s", aws.StringValue(msg.MessageId), err.Error())
+    }
+}
+
+func (p *EventPoller) String() string {
+    return p.QueueURL
+}
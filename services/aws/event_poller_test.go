@@ -0,0 +1,124 @@
+package aws
+
+import (
+    "crypto/md5"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+)
+
+// fakeQueue is a local stand-in for the SQS JSON API, holding messages
+// until they are deleted.
+type fakeQueue struct {
+    mu       sync.Mutex
+    messages map[string]string
+    deleted  []string
+}
+
+func (q *fakeQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+    switch r.Header.Get("X-Amz-Target") {
+    case "AmazonSQS.ReceiveMessage":
+        messages := make([]map[string]string, 0, len(q.messages))
+        for handle, body := range q.messages {
+            sum := md5.Sum([]byte(body))
+            messages = append(messages, map[string]string{
+                "MessageId": handle,
+                "ReceiptHandle": handle,
+                "Body": body,
+                "MD5OfBody": hex.EncodeToString(sum[:]),
+            })
+        }
+        if len(messages) == 0 {
+            // Stand in for the long poll without holding the test up.
+            q.mu.Unlock()
+            time.Sleep(10 * time.Millisecond)
+            q.mu.Lock()
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"Messages": messages})
+    case "AmazonSQS.DeleteMessage":
+        var input struct {
+            ReceiptHandle string
+        }
+        json.NewDecoder(r.Body).Decode(&input)
+        delete(q.messages, input.ReceiptHandle)
+        q.deleted = append(q.deleted, input.ReceiptHandle)
+        w.Write([]byte("{}"))
+    default:
+        w.WriteHeader(400)
+        w.Write([]byte(`{"__type": "InvalidAction"}`))
+    }
+}
+
+func (q *fakeQueue) deletedCount() int {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return len(q.deleted)
+}
+
+func TestEventPollerAppliesQueuedEvents(t *testing.T) {
+    queue := &fakeQueue{messages: map[string]string{
+        "m1": `{"detail-type": "EC2 Instance State-change Notification", "detail": {"instance-id": "i-0000000000000001", "state": "terminated"}}`,
+        "m2": `{"detail-type": "Something else"}`,
+    }}
+    server := httptest.NewServer(queue)
+    defer server.Close()
+
+    s, _ := newTestService(t, Config{
+        Region: "us-east-1",
+        AccessKeyID: "test",
+        SecretAccessKey: "test",
+        EventQueueURL: server.URL + "/123456789012/events",
+        EventQueueEndpoint: server.URL,
+    }, testInventory)
+
+    deadline := time.Now().Add(5 * time.Second)
+    for queue.deletedCount() < 2 {
+        if time.Now().After(deadline) {
+            t.Fatalf("messages not consumed, %d deleted", queue.deletedCount())
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if instances := s.GetEC2FromName("web"); len(instances) != 0 {
+        t.Errorf("terminated instance still answered: %+v", instances)
+    }
+    if instances := s.GetEC2FromName("db"); len(instances) != 1 {
+        t.Errorf("db lost: %+v", instances)
+    }
+}
+
+func TestEventQueueRegion(t *testing.T) {
+    sources := map[string]*SourceConfig{"prod": {Region: []string{"eu-west-1"}}}
+    for _, test := range []struct {
+        c      Config
+        region string
+    }{
+        {Config{EventQueueURL: "https://sqs.us-west-2.amazonaws.com/123456789012/events", Sources: sources}, "us-west-2"},
+        {Config{EventQueueURL: "https://sqs.us-west-2.amazonaws.com/123456789012/events", Region: "us-east-1"}, "us-east-1"},
+        {Config{EventQueueURL: "http://localhost:9324/123456789012/events", EventQueueRegion: "eu-west-1"}, "eu-west-1"},
+        {Config{EventQueueURL: "http://localhost:9324/123456789012/events", Sources: sources}, ""},
+    } {
+        err, poller := NewEventPoller(&test.c, nil)
+        if test.region == "" {
+            if err == nil {
+                t.Errorf("%s: no region and no error", test.c.EventQueueURL)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: %s", test.c.EventQueueURL, err.Error())
+            continue
+        }
+        if region := aws.StringValue(poller.client.Config.Region); region != test.region {
+            t.Errorf("%s: region %q, want %q", test.c.EventQueueURL, region, test.region)
+        }
+    }
+}
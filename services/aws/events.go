@@ -0,0 +1,185 @@
+package aws
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+)
+
+const (
+    instanceStateChangeDetailType = "EC2 Instance State-change Notification"
+    instanceStateTerminated       = "terminated"
+)
+
+var (
+    errNotInstanceStateEvent = errors.New("not an EC2 instance state-change event")
+    errNotInSource           = errors.New("instance does not belong to this source")
+    errCannotConfirm         = errors.New("the inventory source cannot look up instances to confirm events")
+    EventNotConfirmedError   = errors.New("event does not match the instance state")
+)
+
+// InstanceStateEvent is the EventBridge "EC2 Instance State-change
+// Notification" event.
+type InstanceStateEvent struct {
+    DetailType string    `json:"detail-type"`
+    Source     string    `json:"source"`
+    Account    string    `json:"account"`
+    Region     string    `json:"region"`
+    Time       time.Time `json:"time"`
+    Detail     struct {
+        InstanceID string `json:"instance-id"`
+        State      string `json:"state"`
+    } `json:"detail"`
+}
+
+// InstanceLookup is implemented by sources that can fetch a single
+// instance, which lets events upsert complete records into the cache.
+type InstanceLookup interface {
+    LookupInstance(ctx context.Context, account string, region string, id string) (error, *EC2Instance)
+}
+
+// snsEnvelope is how the event arrives when the queue is subscribed to an
+// SNS topic rather than targeted by EventBridge directly.
+type snsEnvelope struct {
+    Type    string
+    Message string
+}
+
+func ParseInstanceStateEvent(data []byte) (error, *InstanceStateEvent) {
+    envelope := &snsEnvelope{}
+    if err := json.Unmarshal(data, envelope); err == nil && envelope.Type == "Notification" && envelope.Message != "" {
+        data = []byte(envelope.Message)
+    }
+    event := &InstanceStateEvent{}
+    if err := json.Unmarshal(data, event); err != nil {
+        return err, nil
+    }
+    if event.DetailType != instanceStateChangeDetailType || event.Detail.InstanceID == "" || event.Detail.State == "" {
+        return errNotInstanceStateEvent, nil
+    }
+    return nil, event
+}
+
+// ConfirmInstanceStateEvent checks an event against the source before it
+// is applied, for events that did not come from a trusted queue. The
+// instance has to be in the event's state, or be gone for terminations.
+func (s *Service) ConfirmInstanceStateEvent(ctx context.Context, event *InstanceStateEvent) error {
+    lookup, ok := s.Source.(InstanceLookup)
+    if !ok {
+        return errCannotConfirm
+    }
+    err, inst := lookup.LookupInstance(ctx, event.Account, event.Region, event.Detail.InstanceID)
+    if err == notFoundError && event.Detail.State == instanceStateTerminated {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if inst.State != event.Detail.State {
+        return EventNotConfirmedError
+    }
+    return nil
+}
+
+// instanceUpdate is an event applied to the cache, kept so a refresh that
+// was listing while it came in can apply it again. inst is nil once the
+// instance terminated.
+type instanceUpdate struct {
+    id      string
+    inst    *EC2Instance
+    applied time.Time
+}
+
+// ApplyInstanceStateEvent upserts the instance named by the event into the
+// cache, or drops it once terminated. A successful lookup is newer than the
+// event and wins over the event's state. Events older than the cached
+// instance are stale and ignored. Periodic refreshes still reconcile
+// anything an event missed.
+func (s *Service) ApplyInstanceStateEvent(ctx context.Context, event *InstanceStateEvent) error {
+    id := event.Detail.InstanceID
+    state := event.Detail.State
+    var updated *EC2Instance
+    if state != instanceStateTerminated {
+        if lookup, ok := s.Source.(InstanceLookup); ok {
+            err, inst := lookup.LookupInstance(ctx, event.Account, event.Region, id)
+            if err != nil {
+                s.logger.Printf("lookup of %s failed, applying state only: %s", id, err.Error())
+            } else {
+                updated = s.namingPolicy.apply([]*EC2Instance{inst})[0]
+            }
+        }
+    }
+
+    s.updateMu.Lock()
+    defer s.updateMu.Unlock()
+    inv := s.inventory()
+    var cached *EC2Instance
+    for _, inst := range inv.all {
+        if inst.ID == id {
+            cached = inst
+            break
+        }
+    }
+    if cached != nil && !event.Time.IsZero() && event.Time.Before(cached.UpdateTime) {
+        s.logger.Printf("ignored %s event for %s older than the cached instance", state, id)
+        return nil
+    }
+    if state != instanceStateTerminated && updated == nil {
+        if cached == nil {
+            return fmt.Errorf("instance %s is not cached and could not be looked up", id)
+        }
+        copied := *cached
+        copied.State = state
+        copied.UpdateTime = event.Time
+        if copied.UpdateTime.IsZero() {
+            copied.UpdateTime = time.Now()
+        }
+        updated = &copied
+    }
+    s.applied = append(s.applied, instanceUpdate{id: id, inst: updated, applied: time.Now()})
+    all := replaceInstance(inv.all, id, updated)
+    s.cache.Store(newInventory(all, inv.resources, s.statePolicy, s.namingPolicy))
+    s.logger.Printf("applied %s event for %s", state, id)
+    s.cacheUpdated()
+    return nil
+}
+
+// replayUpdates applies the events that came in after a listing started on
+// top of it and forgets the older ones, which the listing reflects. The
+// caller holds updateMu.
+func (s *Service) replayUpdates(instances []*EC2Instance, started time.Time) []*EC2Instance {
+    var kept []instanceUpdate
+    for _, update := range s.applied {
+        if update.applied.Before(started) {
+            continue
+        }
+        kept = append(kept, update)
+        instances = replaceInstance(instances, update.id, update.inst)
+    }
+    s.applied = kept
+    return instances
+}
+
+// replaceInstance returns a copy of instances with the one called id
+// replaced by inst, or removed when inst is nil. inst is added when id is
+// not listed.
+func replaceInstance(instances []*EC2Instance, id string, inst *EC2Instance) []*EC2Instance {
+    replaced := make([]*EC2Instance, 0, len(instances) + 1)
+    found := false
+    for _, current := range instances {
+        if current.ID != id {
+            replaced = append(replaced, current)
+            continue
+        }
+        found = true
+        if inst != nil {
+            replaced = append(replaced, inst)
+        }
+    }
+    if !found && inst != nil {
+        replaced = append(replaced, inst)
+    }
+    return replaced
+}
@@ -0,0 +1,111 @@
+package aws
+
+import (
+    "context"
+    "sync"
+    "testing"
+    "time"
+)
+
+func stateEvent(id string, state string, at time.Time) *InstanceStateEvent {
+    event := &InstanceStateEvent{DetailType: instanceStateChangeDetailType, Time: at}
+    event.Detail.InstanceID = id
+    event.Detail.State = state
+    return event
+}
+
+func TestLateEventKeepsLookedUpState(t *testing.T) {
+    s, _ := newTestService(t, Config{}, testInventory)
+
+    // The static source still reports web as running.
+    if err := s.ApplyInstanceStateEvent(context.Background(), stateEvent("i-0000000000000001", "stopping", time.Time{})); err != nil {
+        t.Fatal(err)
+    }
+    if err, inst := s.GetEC2FromID("i-0000000000000001"); err != nil || inst.State != "running" {
+        t.Errorf("web after a late stopping event: %+v, %v", inst, err)
+    }
+    if instances := s.GetEC2FromName("web"); len(instances) != 1 {
+        t.Errorf("web not answered: %+v", instances)
+    }
+}
+
+func TestEventOlderThanCacheIsIgnored(t *testing.T) {
+    cachedAt := time.Now()
+    s := NewService(Config{RefreshInterval: "1h"})
+    s.Source = &stubSource{instances: []*EC2Instance{{ID: "i-1", Name: "web", State: "running", PrivateIP: "10.0.1.10", UpdateTime: cachedAt}}}
+    if err := s.Open(); err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+
+    if err := s.ApplyInstanceStateEvent(context.Background(), stateEvent("i-1", "stopped", cachedAt.Add(-time.Minute))); err != nil {
+        t.Fatal(err)
+    }
+    if instances := s.GetEC2FromName("web"); len(instances) != 1 || instances[0].State != "running" {
+        t.Errorf("stale event applied: %+v", instances)
+    }
+
+    if err := s.ApplyInstanceStateEvent(context.Background(), stateEvent("i-1", "stopped", cachedAt.Add(time.Minute))); err != nil {
+        t.Fatal(err)
+    }
+    if instances := s.GetEC2FromName("web"); len(instances) != 0 {
+        t.Errorf("newer event not applied: %+v", instances)
+    }
+    // An older event for the state it already left does not bring it back.
+    if err := s.ApplyInstanceStateEvent(context.Background(), stateEvent("i-1", "running", cachedAt)); err != nil {
+        t.Fatal(err)
+    }
+    if err, inst := s.GetEC2FromID("i-1"); err == nil || inst.State == "running" {
+        t.Errorf("out of order event applied: %+v", inst)
+    }
+}
+
+// slowSource lists its instances at once the first time and then waits for
+// release, so events can arrive while a refresh is listing.
+type slowSource struct {
+    stubSource
+    mu      sync.Mutex
+    listed  bool
+    entered chan struct{}
+    release chan struct{}
+}
+
+func (s *slowSource) ListInstances(ctx context.Context) (error, []*EC2Instance) {
+    s.mu.Lock()
+    first := !s.listed
+    s.listed = true
+    s.mu.Unlock()
+    if !first {
+        close(s.entered)
+        <-s.release
+    }
+    return s.stubSource.ListInstances(ctx)
+}
+
+func TestEventDuringRefreshIsKept(t *testing.T) {
+    source := &slowSource{
+        stubSource: stubSource{instances: []*EC2Instance{{ID: "i-1", Name: "web", State: "running", PrivateIP: "10.0.1.10"}}},
+        entered: make(chan struct{}),
+        release: make(chan struct{}),
+    }
+    s := NewService(Config{RefreshInterval: "1h"})
+    s.Source = source
+    if err := s.Open(); err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+
+    done := make(chan error)
+    go func() { done <- s.UpdateCache() }()
+    <-source.entered
+    if err := s.ApplyInstanceStateEvent(context.Background(), stateEvent("i-1", instanceStateTerminated, time.Now())); err != nil {
+        t.Fatal(err)
+    }
+    close(source.release)
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+    if instances := s.GetEC2FromName("web"); len(instances) != 0 {
+        t.Errorf("refresh brought back a terminated instance: %+v", instances)
+    }
+}
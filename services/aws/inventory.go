@@ -0,0 +1,180 @@
+package aws
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+    "sync"
+)
+
+const (
+    InventoryEC2    = "ec2"
+    InventoryStatic = "static"
+    DefaultSource   = "default"
+)
+
+// InventorySource lists the instances the service caches. The EC2 source
+// talks to AWS, the static source reads a local file so the server can run
+// offline.
+type InventorySource interface {
+    ListInstances(ctx context.Context) (error, []*EC2Instance)
+}
+
+func newInventorySource(c *Config) (error, InventorySource) {
+    sources := c.sources()
+    names := make([]string, 0, len(sources))
+    for name := range sources {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    children := make([]InventorySource, 0, len(names))
+    for _, name := range names {
+        err, s := newSourcesFromConfig(name, sources[name], c)
+        if err != nil {
+            return err, nil
+        }
+        children = append(children, s...)
+    }
+    if len(children) == 1 {
+        return nil, children[0]
+    }
+    return nil, newMultiSource(children)
+}
+
+func newSourcesFromConfig(name string, sc *SourceConfig, c *Config) (error, []InventorySource) {
+    switch sc.Inventory {
+    case "", InventoryEC2:
+        if len(sc.Region) == 0 {
+            return fmt.Errorf("Region is required for source %s", name), nil
+        }
+        sources := make([]InventorySource, 0, len(sc.Region))
+        for _, region := range sc.Region {
+            err, sess := newSession(name, region, sc)
+            if err != nil {
+                return err, nil
+            }
+            sources = append(sources, NewEC2Source(name, region, sess, sc, c))
+        }
+        return nil, sources
+    case InventoryStatic:
+        if sc.InventoryFile == "" {
+            return fmt.Errorf("InventoryFile is required for %s inventory in source %s", InventoryStatic, name), nil
+        }
+        return nil, []InventorySource{NewStaticSource(name, sc.InventoryFile)}
+    }
+    return fmt.Errorf("unknown inventory %q in source %s", sc.Inventory, name), nil
+}
+
+// multiSource refreshes several sources concurrently and merges the result.
+// A source that fails keeps contributing its last successful listing so one
+// unreachable region does not empty the cache.
+type multiSource struct {
+    sources       []InventorySource
+    logger        *log.Logger
+    mu            sync.Mutex
+    last          map[int][]*EC2Instance
+    lastResources map[int]*Resources
+}
+
+func newMultiSource(sources []InventorySource) *multiSource {
+    return &multiSource{
+        sources: sources,
+        logger: log.New(os.Stderr, "[aws] ", log.LstdFlags),
+        last: make(map[int][]*EC2Instance, len(sources)),
+        lastResources: make(map[int]*Resources, len(sources)),
+    }
+}
+
+func (m *multiSource) LookupInstance(ctx context.Context, account string, region string, id string) (error, *EC2Instance) {
+    err := notFoundError
+    for _, source := range m.sources {
+        lookup, ok := source.(InstanceLookup)
+        if !ok {
+            continue
+        }
+        lookupErr, inst := lookup.LookupInstance(ctx, account, region, id)
+        if lookupErr == nil {
+            return nil, inst
+        }
+        if lookupErr != errNotInSource && lookupErr != notFoundError {
+            err = lookupErr
+        }
+    }
+    return err, nil
+}
+
+func (m *multiSource) ListInstances(ctx context.Context) (error, []*EC2Instance) {
+    results := make([][]*EC2Instance, len(m.sources))
+    errs := make([]error, len(m.sources))
+    var wg sync.WaitGroup
+    for i, source := range m.sources {
+        wg.Add(1)
+        go func(i int, source InventorySource) {
+            defer wg.Done()
+            errs[i], results[i] = source.ListInstances(ctx)
+        }(i, source)
+    }
+    wg.Wait()
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    failed := 0
+    var lastErr error
+    instances := make([]*EC2Instance, 0, 10)
+    for i := range m.sources {
+        if errs[i] != nil {
+            failed += 1
+            lastErr = errs[i]
+            m.logger.Printf("source %s failed, keeping previous result: %s", m.sources[i], errs[i].Error())
+            instances = append(instances, m.last[i]...)
+            continue
+        }
+        m.last[i] = results[i]
+        instances = append(instances, results[i]...)
+    }
+    if failed == len(m.sources) {
+        return lastErr, nil
+    }
+    return nil, instances
+}
+
+func (m *multiSource) ListResources(ctx context.Context) (error, *Resources) {
+    results := make([]*Resources, len(m.sources))
+    errs := make([]error, len(m.sources))
+    var wg sync.WaitGroup
+    for i, source := range m.sources {
+        resourceSource, ok := source.(ResourceSource)
+        if !ok {
+            continue
+        }
+        wg.Add(1)
+        go func(i int, source ResourceSource) {
+            defer wg.Done()
+            errs[i], results[i] = source.ListResources(ctx)
+        }(i, resourceSource)
+    }
+    wg.Wait()
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    failed := 0
+    var lastErr error
+    resources := &Resources{}
+    for i := range m.sources {
+        if errs[i] != nil {
+            failed += 1
+            lastErr = errs[i]
+            m.logger.Printf("source %s failed listing resources, keeping previous result: %s", m.sources[i], errs[i].Error())
+            resources.merge(m.lastResources[i])
+            continue
+        }
+        m.lastResources[i] = results[i]
+        resources.merge(results[i])
+    }
+    if failed == len(m.sources) {
+        return lastErr, nil
+    }
+    return nil, resources
+}
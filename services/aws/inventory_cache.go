@@ -0,0 +1,308 @@
+package aws
+
+import (
+    "sort"
+    "strings"
+)
+
+// inventory is an immutable snapshot of the cached instances. A refresh
+// builds a new one and swaps it in, so readers never need a lock. The
+// indexes only cover instances allowed by the state policy, all keeps the
+// full listing for diagnostic lookups.
+type inventory struct {
+    all         []*EC2Instance
+    instances   []*EC2Instance
+    resources   *Resources
+    byName      map[string][]*EC2Instance
+    byUnique    map[string]*EC2Instance
+    parents     map[string]bool
+    srv         srvIndex
+    conflicts   map[string][]*EC2Instance
+    naming      namingPolicy
+    byID        map[string]*EC2Instance
+    byPrivateIP map[string][]*EC2Instance
+    byPublicIP  map[string][]*EC2Instance
+    byDNS       map[string]*EC2Instance
+    sources     map[string]string
+    accounts    map[string]string
+    regions     map[string]string
+    databases   map[string][]*RDSDatabase
+    lbs         map[string][]*LoadBalancer
+    asgs        map[string][]*AutoScalingGroup
+    ecsTasks    map[string][]*ECSTask
+    addresses   map[string][]*NetworkAddress
+}
+
+var emptyInventory = newInventory(nil, nil, nil, namingPolicy{})
+
+func newInventory(all []*EC2Instance, resources *Resources, policy StatePolicy, naming namingPolicy) *inventory {
+    instances := policy.filter(all)
+    if resources == nil {
+        resources = &Resources{}
+    }
+    inv := &inventory{
+        all: all,
+        instances: instances,
+        resources: resources,
+        byName: make(map[string][]*EC2Instance, len(instances)),
+        byUnique: make(map[string]*EC2Instance),
+        parents: make(map[string]bool),
+        conflicts: make(map[string][]*EC2Instance),
+        naming: naming,
+        byID: make(map[string]*EC2Instance, len(instances)),
+        byPrivateIP: make(map[string][]*EC2Instance, len(instances)),
+        byPublicIP: make(map[string][]*EC2Instance, len(instances)),
+        byDNS: make(map[string]*EC2Instance, len(instances) * 2),
+        sources: make(map[string]string),
+        accounts: make(map[string]string),
+        regions: make(map[string]string),
+        databases: make(map[string][]*RDSDatabase, len(resources.Databases)),
+        lbs: make(map[string][]*LoadBalancer, len(resources.LoadBalancers)),
+        asgs: make(map[string][]*AutoScalingGroup, len(resources.AutoScalingGroups)),
+        ecsTasks: make(map[string][]*ECSTask),
+        addresses: make(map[string][]*NetworkAddress, len(resources.Addresses)),
+    }
+    for _, inst := range instances {
+        for _, name := range inst.names() {
+            name = strings.ToLower(name)
+            inv.byName[name] = append(inv.byName[name], inst)
+            for idx := strings.Index(name, "."); idx >= 0; idx = strings.Index(name, ".") {
+                name = name[idx + 1:]
+                inv.parents[name] = true
+            }
+        }
+        if inst.ID != "" {
+            inv.byID[inst.ID] = inst
+        }
+        for _, ip := range inst.privateAddresses() {
+            inv.byPrivateIP[ip] = append(inv.byPrivateIP[ip], inst)
+        }
+        if inst.PublicIP != "" {
+            inv.byPublicIP[inst.PublicIP] = append(inv.byPublicIP[inst.PublicIP], inst)
+        }
+        for _, ip := range inst.IPv6Addresses {
+            inv.byPublicIP[ip] = append(inv.byPublicIP[ip], inst)
+        }
+        if inst.PublicDNS != "" {
+            inv.byDNS[normalizeDNSName(inst.PublicDNS)] = inst
+        }
+        if inst.PrivateDNS != "" {
+            inv.byDNS[normalizeDNSName(inst.PrivateDNS)] = inst
+        }
+        if inst.Source != "" {
+            inv.sources[strings.ToLower(inst.Source)] = inst.Source
+        }
+        if inst.Account != "" {
+            inv.accounts[strings.ToLower(inst.Account)] = inst.Account
+        }
+        if inst.Region != "" {
+            inv.regions[strings.ToLower(inst.Region)] = inst.Region
+        }
+    }
+    inv.indexConflicts()
+    inv.indexSRV()
+    for _, db := range resources.Databases {
+        inv.databases[db.ID] = append(inv.databases[db.ID], db)
+    }
+    for _, lb := range resources.LoadBalancers {
+        name := strings.ToLower(lb.Name)
+        inv.lbs[name] = append(inv.lbs[name], lb)
+    }
+    for _, group := range resources.AutoScalingGroups {
+        name := strings.ToLower(group.Name)
+        inv.asgs[name] = append(inv.asgs[name], group)
+    }
+    for _, task := range resources.ECSTasks {
+        key := ecsServiceKey(task.Cluster, task.Service)
+        inv.ecsTasks[key] = append(inv.ecsTasks[key], task)
+    }
+    for _, addr := range resources.Addresses {
+        inv.addresses[addr.IP] = append(inv.addresses[addr.IP], addr)
+    }
+    return inv
+}
+
+// indexConflicts records the names shared by several instances and gives
+// each of them the unique names the naming policy asks for, unless a real
+// name already uses it.
+func (inv *inventory) indexConflicts() {
+    if inv.naming.uniqueID {
+        for _, inst := range inv.instances {
+            if id := strings.ToLower(inst.ID); id != "" {
+                if _, taken := inv.byName[id]; !taken {
+                    inv.byUnique[id] = inst
+                }
+            }
+        }
+    }
+    for name, instances := range inv.byName {
+        if name == "" || len(instances) < 2 {
+            continue
+        }
+        sorted := sortByLaunchTime(instances)
+        inv.conflicts[name] = sorted
+        if !inv.naming.uniqueIndex {
+            continue
+        }
+        for i, inst := range sorted {
+            unique := uniqueIndexName(name, i + 1)
+            if _, taken := inv.byName[unique]; !taken {
+                inv.byUnique[unique] = inst
+            }
+        }
+    }
+}
+
+// conflictReport describes every shared name, sorted by name.
+func (inv *inventory) conflictReport(scope Scope) []NameConflict {
+    names := make([]string, 0, len(inv.conflicts))
+    for name := range inv.conflicts {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    report := make([]NameConflict, 0, len(names))
+    for _, name := range names {
+        members := filterScope(inv.conflicts[name], scope, nil)
+        if len(members) < 2 {
+            continue
+        }
+        conflict := NameConflict{
+            Name: name,
+            Policy: inv.naming.duplicates,
+        }
+        if _, selected := inv.naming.selectDuplicates(members); selected != nil {
+            for _, inst := range selected {
+                conflict.Selected = append(conflict.Selected, inst.ID)
+            }
+        }
+        for i, inst := range members {
+            conflict.Instances = append(conflict.Instances, NameConflictMember{
+                ID: inst.ID,
+                UniqueName: inv.uniqueName(name, i + 1, inst),
+                Source: inst.Source,
+                Account: inst.Account,
+                Region: inst.Region,
+                LaunchTime: inst.LaunchTime,
+            })
+        }
+        report = append(report, conflict)
+    }
+    return report
+}
+
+// uniqueName returns the name the n-th instance sharing name is indexed
+// under, if any.
+func (inv *inventory) uniqueName(name string, n int, inst *EC2Instance) string {
+    if unique := uniqueIndexName(name, n); inv.byUnique[unique] == inst {
+        return unique
+    }
+    if id := strings.ToLower(inst.ID); inv.byUnique[id] == inst {
+        return id
+    }
+    return ""
+}
+
+// candidates returns the instances a scoped lookup has to consider.
+func (inv *inventory) candidates(scope Scope) []*EC2Instance {
+    if scope.States != nil {
+        return inv.all
+    }
+    return inv.instances
+}
+
+// findByName looks a name up ignoring case, as DNS does.
+func (inv *inventory) findByName(name string, scope Scope) []*EC2Instance {
+    name = strings.ToLower(name)
+    if scope.States != nil {
+        return filterScope(inv.all, scope, func(inst *EC2Instance) bool {
+            for _, hostname := range inst.names() {
+                if strings.EqualFold(hostname, name) {
+                    return true
+                }
+            }
+            return false
+        })
+    }
+    if found := filterScope(inv.byName[name], scope, nil); len(found) > 0 {
+        return found
+    }
+    if inst, ok := inv.byUnique[name]; ok && scope.Match(inst) {
+        return []*EC2Instance{inst}
+    }
+    return nil
+}
+
+func (inv *inventory) findByIP(ip string, scope Scope) *EC2Instance {
+    if scope.States != nil {
+        found := filterScope(inv.all, scope, func(inst *EC2Instance) bool {
+            for _, addr := range inst.Addresses() {
+                if addr == ip {
+                    return true
+                }
+            }
+            return false
+        })
+        if len(found) > 0 {
+            return found[0]
+        }
+        return nil
+    }
+    if found := filterScope(inv.byPrivateIP[ip], scope, nil); len(found) > 0 {
+        return found[0]
+    }
+    if found := filterScope(inv.byPublicIP[ip], scope, nil); len(found) > 0 {
+        return found[0]
+    }
+    return nil
+}
+
+// scopeFromLabel interprets the last label of a DNS name as a source,
+// account or region known to the inventory, ignoring case. The indexes map
+// lower case labels to the values as the instances spell them.
+func (inv *inventory) scopeFromLabel(label string) (Scope, bool) {
+    label = strings.ToLower(label)
+    if source, ok := inv.sources[label]; ok {
+        return Scope{Source: source}, true
+    }
+    if account, ok := inv.accounts[label]; ok {
+        return Scope{Account: account}, true
+    }
+    if region, ok := inv.regions[label]; ok {
+        return Scope{Region: region}, true
+    }
+    return Scope{}, false
+}
+
+func filterScope(instances []*EC2Instance, scope Scope, filterFunc func(*EC2Instance) bool) []*EC2Instance {
+    if scope.IsEmpty() && filterFunc == nil {
+        return instances
+    }
+    filtered := make([]*EC2Instance, 0, len(instances))
+    for _, inst := range instances {
+        if scope.Match(inst) && (filterFunc == nil || filterFunc(inst)) {
+            filtered = append(filtered, inst)
+        }
+    }
+    return filtered
+}
+
+func (inst *EC2Instance) privateAddresses() []string {
+    addresses := make([]string, 0, len(inst.PrivateIPs) + 1)
+    if inst.PrivateIP != "" {
+        addresses = append(addresses, inst.PrivateIP)
+    }
+    for _, ip := range inst.PrivateIPs {
+        if ip != inst.PrivateIP {
+            addresses = append(addresses, ip)
+        }
+    }
+    return addresses
+}
+
+func ecsServiceKey(cluster string, service string) string {
+    return strings.ToLower(cluster) + "/" + strings.ToLower(service)
+}
+
+func normalizeDNSName(name string) string {
+    return strings.TrimSuffix(strings.ToLower(name), ".")
+}
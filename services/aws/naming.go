@@ -0,0 +1,198 @@
+package aws
+
+import (
+    "fmt"
+    "strings"
+)
+
+const (
+    defaultAliasTag = "dns:aliases"
+    idSuffixLength  = 8
+)
+
+// namingPolicy turns instances into the hostnames they are served under.
+// Every template that renders gives one hostname, the first becoming the
+// instance Name, and the alias tag adds any number of extra ones.
+type namingPolicy struct {
+    templates   []nameTemplate
+    aliasTag    string
+    srvTag      string
+    duplicates  string
+    uniqueIndex bool
+    uniqueID    bool
+}
+
+// nameTemplate is a parsed NameTemplate such as "{tag:Role}-{az}-{id-suffix}".
+// A placeholder may list fallbacks, "{tag:Role|tag:Name|id}", and the first
+// one with a value is used. The template does not render at all if a
+// placeholder has no value.
+type nameTemplate struct {
+    source string
+    parts  []namePart
+}
+
+type namePart struct {
+    literal string
+    fields  []string
+}
+
+var nameFields = map[string]func(*EC2Instance) string{
+    "name": func(inst *EC2Instance) string { return inst.Tags["Name"] },
+    "id": func(inst *EC2Instance) string { return inst.ID },
+    "id-suffix": func(inst *EC2Instance) string {
+        id := strings.TrimPrefix(inst.ID, "i-")
+        if len(id) > idSuffixLength {
+            id = id[len(id) - idSuffixLength:]
+        }
+        return id
+    },
+    "az": func(inst *EC2Instance) string { return inst.AvailabilityZone },
+    "region": func(inst *EC2Instance) string { return inst.Region },
+    "account": func(inst *EC2Instance) string { return inst.Account },
+    "source": func(inst *EC2Instance) string { return inst.Source },
+    "type": func(inst *EC2Instance) string { return inst.InstanceType },
+    "vpc": func(inst *EC2Instance) string { return inst.VpcID },
+    "subnet": func(inst *EC2Instance) string { return inst.SubnetID },
+}
+
+func newNamingPolicy(c *Config) (error, namingPolicy) {
+    p := namingPolicy{
+        aliasTag: defaultAliasTag,
+        srvTag: defaultSRVTag,
+    }
+    if c.AliasTag != "" {
+        p.aliasTag = c.AliasTag
+    }
+    if c.SRVTag != "" {
+        p.srvTag = c.SRVTag
+    }
+    for _, source := range c.NameTemplate {
+        err, tmpl := parseNameTemplate(source)
+        if err != nil {
+            return err, p
+        }
+        p.templates = append(p.templates, tmpl)
+    }
+    if err := parseDuplicatePolicy(c, &p); err != nil {
+        return err, p
+    }
+    return nil, p
+}
+
+func parseNameTemplate(source string) (error, nameTemplate) {
+    tmpl := nameTemplate{source: source}
+    rest := source
+    for rest != "" {
+        start := strings.Index(rest, "{")
+        if start < 0 {
+            tmpl.parts = append(tmpl.parts, namePart{literal: rest})
+            break
+        }
+        if start > 0 {
+            tmpl.parts = append(tmpl.parts, namePart{literal: rest[:start]})
+        }
+        end := strings.Index(rest[start:], "}")
+        if end < 0 {
+            return fmt.Errorf("bad NameTemplate %q: unclosed placeholder", source), tmpl
+        }
+        fields := strings.Split(rest[start + 1:start + end], "|")
+        for i, field := range fields {
+            field = strings.TrimSpace(field)
+            if _, ok := nameFields[field]; !ok && !strings.HasPrefix(field, "tag:") {
+                return fmt.Errorf("bad NameTemplate %q: unknown placeholder %q", source, field), tmpl
+            }
+            fields[i] = field
+        }
+        tmpl.parts = append(tmpl.parts, namePart{fields: fields})
+        rest = rest[start + end + 1:]
+    }
+    return nil, tmpl
+}
+
+func (t nameTemplate) render(inst *EC2Instance) (string, bool) {
+    var b strings.Builder
+    for _, part := range t.parts {
+        if part.fields == nil {
+            b.WriteString(part.literal)
+            continue
+        }
+        value := ""
+        for _, field := range part.fields {
+            if strings.HasPrefix(field, "tag:") {
+                value = inst.Tags[strings.TrimPrefix(field, "tag:")]
+            } else {
+                value = nameFields[field](inst)
+            }
+            if value != "" {
+                break
+            }
+        }
+        if value == "" {
+            return "", false
+        }
+        b.WriteString(value)
+    }
+    name := sanitizeHostname(b.String())
+    return name, name != ""
+}
+
+// apply returns copies of the instances with Name and Hostnames set. The
+// instances themselves may still be published, a failed source keeps
+// contributing its previous listing, so they are never modified. Without
+// templates the Name tag is kept as is.
+func (p namingPolicy) apply(instances []*EC2Instance) []*EC2Instance {
+    named := make([]*EC2Instance, 0, len(instances))
+    for _, original := range instances {
+        copied := *original
+        inst := &copied
+        hostnames := make([]string, 0, len(p.templates) + 1)
+        seen := make(map[string]bool)
+        add := func(name string) {
+            if name != "" && !seen[name] {
+                seen[name] = true
+                hostnames = append(hostnames, name)
+            }
+        }
+        for _, tmpl := range p.templates {
+            if name, ok := tmpl.render(inst); ok {
+                add(name)
+            }
+        }
+        if len(hostnames) > 0 {
+            inst.Name = hostnames[0]
+        } else {
+            if tagName := inst.Tags["Name"]; tagName != "" {
+                inst.Name = tagName
+            }
+            add(inst.Name)
+        }
+        for _, alias := range strings.Split(inst.Tags[p.aliasTag], ",") {
+            add(sanitizeHostname(alias))
+        }
+        inst.Hostnames = hostnames
+        named = append(named, inst)
+    }
+    return named
+}
+
+// sanitizeHostname lowercases a rendered name and replaces anything that
+// cannot appear in a DNS name with a dash.
+func sanitizeHostname(name string) string {
+    name = strings.ToLower(strings.TrimSpace(name))
+    mapped := strings.Map(func(r rune) rune {
+        if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+            return r
+        }
+        return '-'
+    }, name)
+    return strings.Trim(mapped, "-.")
+}
+
+// names returns every hostname of the instance, falling back to Name for
+// instances that were never run through a naming policy.
+func (inst *EC2Instance) names() []string {
+    if len(inst.Hostnames) > 0 {
+        return inst.Hostnames
+    }
+    return []string{inst.Name}
+}
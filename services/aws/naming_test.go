@@ -0,0 +1,93 @@
+package aws
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "testing"
+)
+
+func TestNamingPolicyApply(t *testing.T) {
+    err, policy := newNamingPolicy(&Config{NameTemplate: []string{"{tag:Role}-{id-suffix}", "{tag:Missing}"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    original := &EC2Instance{
+        ID: "i-0123456789abcdef0",
+        Name: "Web Server",
+        Tags: map[string]string{"Name": "Web Server", "Role": "Web", "dns:aliases": "www, Front_End"},
+    }
+    named := policy.apply([]*EC2Instance{original})
+    if len(named) != 1 || named[0] == original {
+        t.Fatalf("apply did not copy the instance")
+    }
+    if original.Name != "Web Server" || original.Hostnames != nil {
+        t.Errorf("original modified: %q %v", original.Name, original.Hostnames)
+    }
+    want := []string{"web-9abcdef0", "www", "front-end"}
+    if named[0].Name != want[0] || len(named[0].Hostnames) != len(want) {
+        t.Fatalf("named %q %v, want %v", named[0].Name, named[0].Hostnames, want)
+    }
+    for i, name := range want {
+        if named[0].Hostnames[i] != name {
+            t.Errorf("hostname %d: %q, want %q", i, named[0].Hostnames[i], name)
+        }
+    }
+}
+
+// flakySource lists its instances once and then fails, so a multiSource
+// keeps serving that first listing.
+type flakySource struct {
+    mu        sync.Mutex
+    instances []*EC2Instance
+    listed    bool
+}
+
+func (f *flakySource) ListInstances(ctx context.Context) (error, []*EC2Instance) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if f.listed {
+        return errors.New("unreachable"), nil
+    }
+    f.listed = true
+    return nil, f.instances
+}
+
+// Run with -race: refreshing while a source is down must not rewrite the
+// instances the published inventory hands to readers.
+func TestRefreshWithFailedSourceDoesNotModifyPublishedInstances(t *testing.T) {
+    s := NewService(Config{RefreshInterval: "1h", NameTemplate: []string{"{tag:Role}-{id-suffix}"}})
+    s.Source = newMultiSource([]InventorySource{
+        &flakySource{instances: []*EC2Instance{{ID: "i-00000001", State: "running", Tags: map[string]string{"Role": "web"}}}},
+        &stubSource{instances: []*EC2Instance{{ID: "i-00000002", State: "running", Tags: map[string]string{"Role": "db"}}}},
+    })
+    if err := s.Open(); err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+
+    done := make(chan struct{})
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for {
+            select {
+            case <-done:
+                return
+            default:
+            }
+            if err, instances := s.ResolveEC2Name("web-00000001", Scope{}); err != nil || len(instances) != 1 {
+                t.Errorf("web lookup: %v, %v", instances, err)
+                return
+            }
+        }
+    }()
+    for i := 0; i < 50; i++ {
+        if err := s.UpdateCache(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    close(done)
+    wg.Wait()
+}
@@ -0,0 +1,115 @@
+package aws
+
+import (
+    "context"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/rds"
+)
+
+const (
+    RDSKindInstance = "instance"
+    RDSKindCluster  = "cluster"
+)
+
+// RDSDatabase is an RDS DB instance or an Aurora cluster. Clusters carry
+// both the writer Endpoint and the ReaderEndpoint.
+type RDSDatabase struct {
+    ID             string
+    Kind           string
+    Source         string
+    Account        string
+    Region         string
+    Engine         string
+    EngineVersion  string
+    Status         string
+    Endpoint       string
+    ReaderEndpoint string
+    Port           int64
+    ClusterID      string
+    Tags           map[string]string
+    UpdateTime     time.Time
+}
+
+func (s *EC2Source) listDatabases(ctx context.Context) (error, []*RDSDatabase) {
+    account := s.Account(ctx)
+    databases := make([]*RDSDatabase, 0, 10)
+    err := s.retryThrottled(ctx, "describe db instances", func() error {
+        databases = databases[:0]
+        return s.rds.DescribeDBInstancesPagesWithContext(ctx, &rds.DescribeDBInstancesInput{},
+            func(page *rds.DescribeDBInstancesOutput, lastPage bool) bool {
+                for _, inst := range page.DBInstances {
+                    databases = append(databases, newRDSInstance(inst))
+                }
+                return true
+            })
+    })
+    if err != nil {
+        return err, nil
+    }
+    instanceCount := len(databases)
+    err = s.retryThrottled(ctx, "describe db clusters", func() error {
+        databases = databases[:instanceCount]
+        return s.rds.DescribeDBClustersPagesWithContext(ctx, &rds.DescribeDBClustersInput{},
+            func(page *rds.DescribeDBClustersOutput, lastPage bool) bool {
+                for _, cluster := range page.DBClusters {
+                    databases = append(databases, newRDSCluster(cluster))
+                }
+                return true
+            })
+    })
+    if err != nil {
+        return err, nil
+    }
+    for _, db := range databases {
+        db.Source = s.Name
+        db.Account = account
+        db.Region = s.Region
+    }
+    s.logger.Printf("%s: fetched %d rds instances and %d clusters", s, instanceCount, len(databases) - instanceCount)
+    return nil, databases
+}
+
+func newRDSInstance(inst *rds.DBInstance) *RDSDatabase {
+    db := &RDSDatabase{
+        ID: aws.StringValue(inst.DBInstanceIdentifier),
+        Kind: RDSKindInstance,
+        Engine: aws.StringValue(inst.Engine),
+        EngineVersion: aws.StringValue(inst.EngineVersion),
+        Status: aws.StringValue(inst.DBInstanceStatus),
+        ClusterID: aws.StringValue(inst.DBClusterIdentifier),
+        Tags: rdsTags(inst.TagList),
+        UpdateTime: time.Now(),
+    }
+    if inst.Endpoint != nil {
+        db.Endpoint = aws.StringValue(inst.Endpoint.Address)
+        db.Port = aws.Int64Value(inst.Endpoint.Port)
+    }
+    return db
+}
+
+func newRDSCluster(cluster *rds.DBCluster) *RDSDatabase {
+    return &RDSDatabase{
+        ID: aws.StringValue(cluster.DBClusterIdentifier),
+        Kind: RDSKindCluster,
+        Engine: aws.StringValue(cluster.Engine),
+        EngineVersion: aws.StringValue(cluster.EngineVersion),
+        Status: aws.StringValue(cluster.Status),
+        Endpoint: aws.StringValue(cluster.Endpoint),
+        ReaderEndpoint: aws.StringValue(cluster.ReaderEndpoint),
+        Port: aws.Int64Value(cluster.Port),
+        Tags: rdsTags(cluster.TagList),
+        UpdateTime: time.Now(),
+    }
+}
+
+func rdsTags(tagList []*rds.Tag) map[string]string {
+    tags := make(map[string]string, len(tagList))
+    for _, tag := range tagList {
+        if tag.Key != nil {
+            tags[*tag.Key] = aws.StringValue(tag.Value)
+        }
+    }
+    return tags
+}
@@ -0,0 +1,158 @@
+package aws
+
+import (
+    "fmt"
+    "math/rand"
+    "sync"
+    "time"
+)
+
+const (
+    defaultRefreshInterval = 30 * time.Second
+    defaultMaxBackoff      = 5 * time.Minute
+    defaultStaleAfter      = 5 * time.Minute
+)
+
+type refreshPolicy struct {
+    interval   time.Duration
+    jitter     time.Duration
+    maxBackoff time.Duration
+    staleAfter time.Duration
+}
+
+// Health describes how fresh the cached inventory is. The cache is stale
+// once no refresh has succeeded for longer than the configured Ttl.
+type Health struct {
+    Stale               bool
+    Instances           int
+    LastAttempt         time.Time
+    LastSuccess         time.Time
+    LastError           string
+    ConsecutiveFailures int
+}
+
+type refreshState struct {
+    mu          sync.Mutex
+    lastAttempt time.Time
+    lastSuccess time.Time
+    lastError   error
+    failures    int
+}
+
+func newRefreshPolicy(c *Config) (error, refreshPolicy) {
+    p := refreshPolicy{
+        interval: defaultRefreshInterval,
+        maxBackoff: defaultMaxBackoff,
+        staleAfter: defaultStaleAfter,
+    }
+    var err error
+    if err = parseDuration("RefreshInterval", c.RefreshInterval, &p.interval); err != nil {
+        return err, p
+    }
+    if err = parseDuration("RefreshJitter", c.RefreshJitter, &p.jitter); err != nil {
+        return err, p
+    }
+    if err = parseDuration("MaxBackoff", c.MaxBackoff, &p.maxBackoff); err != nil {
+        return err, p
+    }
+    if c.Ttl > 0 {
+        p.staleAfter = time.Duration(c.Ttl) * time.Second
+    }
+    if p.interval <= 0 {
+        return fmt.Errorf("RefreshInterval must be positive"), p
+    }
+    if p.maxBackoff < p.interval {
+        p.maxBackoff = p.interval
+    }
+    return nil, p
+}
+
+func parseDuration(name string, value string, target *time.Duration) error {
+    if value == "" {
+        return nil
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil {
+        return fmt.Errorf("bad %s %q: %s", name, value, err.Error())
+    }
+    *target = d
+    return nil
+}
+
+// nextDelay doubles the interval for every consecutive failure, up to the
+// backoff limit, and adds a random jitter so several servers do not hit
+// the API in lockstep.
+func (p refreshPolicy) nextDelay(failures int) time.Duration {
+    delay := p.interval
+    for i := 0; i < failures && delay < p.maxBackoff; i++ {
+        delay *= 2
+    }
+    if delay > p.maxBackoff {
+        delay = p.maxBackoff
+    }
+    if p.jitter > 0 {
+        delay += time.Duration(rand.Int63n(int64(p.jitter)))
+    }
+    return delay
+}
+
+func (r *refreshState) record(err error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    now := time.Now()
+    r.lastAttempt = now
+    r.lastError = err
+    if err != nil {
+        r.failures += 1
+    } else {
+        r.failures = 0
+        r.lastSuccess = now
+    }
+}
+
+func (r *refreshState) consecutiveFailures() int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.failures
+}
+
+func (s *Service) refreshLoop(stop chan struct{}, refreshNow bool) {
+    for {
+        delay := s.refreshPolicy.nextDelay(s.refreshState.consecutiveFailures())
+        if refreshNow {
+            delay = 0
+            refreshNow = false
+        }
+        timer := time.NewTimer(delay)
+        select {
+        case <-stop:
+            timer.Stop()
+            return
+        case <-timer.C:
+        }
+        if err := s.UpdateCache(); err != nil {
+            health := s.Health()
+            s.logger.Printf("refresh failed (%d in a row): %s", health.ConsecutiveFailures, err.Error())
+            if health.Stale {
+                s.logger.Printf("inventory is stale, last successful refresh at %s", health.LastSuccess)
+            }
+        }
+    }
+}
+
+func (s *Service) Health() Health {
+    r := &s.refreshState
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    h := Health{
+        Instances: len(s.inventory().instances),
+        LastAttempt: r.lastAttempt,
+        LastSuccess: r.lastSuccess,
+        ConsecutiveFailures: r.failures,
+    }
+    if r.lastError != nil {
+        h.LastError = r.lastError.Error()
+    }
+    h.Stale = r.lastSuccess.IsZero() || time.Since(r.lastSuccess) > s.refreshPolicy.staleAfter
+    return h
+}
@@ -0,0 +1,87 @@
+package aws
+
+import (
+    "io/ioutil"
+    "testing"
+    "time"
+)
+
+func TestNextDelay(t *testing.T) {
+    for _, test := range []struct {
+        failures int
+        jitter   time.Duration
+        min      time.Duration
+        max      time.Duration
+    }{
+        {0, 0, 10 * time.Second, 10 * time.Second},
+        {1, 0, 20 * time.Second, 20 * time.Second},
+        {2, 0, 40 * time.Second, 40 * time.Second},
+        {3, 0, 60 * time.Second, 60 * time.Second},
+        {100, 0, 60 * time.Second, 60 * time.Second},
+        {0, 5 * time.Second, 10 * time.Second, 15 * time.Second},
+        {100, 5 * time.Second, 60 * time.Second, 65 * time.Second},
+    } {
+        p := refreshPolicy{interval: 10 * time.Second, jitter: test.jitter, maxBackoff: time.Minute}
+        for i := 0; i < 100; i++ {
+            delay := p.nextDelay(test.failures)
+            if delay < test.min || delay > test.max || (test.jitter > 0 && delay == test.max) {
+                t.Errorf("%d failures, jitter %s: delay %s outside [%s, %s]", test.failures, test.jitter, delay, test.min, test.max)
+                break
+            }
+        }
+    }
+}
+
+func TestNewRefreshPolicy(t *testing.T) {
+    err, p := newRefreshPolicy(&Config{RefreshInterval: "2m", MaxBackoff: "1m", Ttl: 90})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if p.maxBackoff != 2 * time.Minute || p.staleAfter != 90 * time.Second {
+        t.Errorf("policy: %+v", p)
+    }
+    for _, c := range []Config{{RefreshInterval: "0s"}, {RefreshInterval: "soon"}, {RefreshJitter: "x"}, {MaxBackoff: "-"}} {
+        if err, _ := newRefreshPolicy(&c); err == nil {
+            t.Errorf("%+v accepted", c)
+        }
+    }
+}
+
+func TestStaleAfterFailedRefreshes(t *testing.T) {
+    s, file := newTestService(t, Config{Ttl: 60}, testInventory)
+    if health := s.Health(); health.Stale {
+        t.Fatalf("stale after open: %+v", health)
+    }
+
+    if err := ioutil.WriteFile(file, []byte("not json"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 3; i++ {
+        if err := s.UpdateCache(); err == nil {
+            t.Fatal("refresh of a broken file succeeded")
+        }
+    }
+    // Failures alone do not make the cache stale until the Ttl has passed.
+    health := s.Health()
+    if health.Stale || health.ConsecutiveFailures != 3 || health.LastError == "" {
+        t.Errorf("health after failures within the ttl: %+v", health)
+    }
+    s.refreshState.mu.Lock()
+    s.refreshState.lastSuccess = time.Now().Add(-2 * time.Minute)
+    s.refreshState.mu.Unlock()
+    health = s.Health()
+    if !health.Stale || health.Instances != 2 {
+        t.Errorf("health after the ttl passed: %+v", health)
+    }
+
+    if err := ioutil.WriteFile(file, []byte(testInventory), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.UpdateCache(); err != nil {
+        t.Fatal(err)
+    }
+    health = s.Health()
+    if health.Stale || health.ConsecutiveFailures != 0 || health.LastError != "" {
+        t.Errorf("health after recovering: %+v", health)
+    }
+}
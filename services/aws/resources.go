@@ -0,0 +1,44 @@
+package aws
+
+import (
+    "context"
+)
+
+const (
+    DiscoverRDS = "rds"
+    DiscoverELB = "elb"
+    DiscoverASG = "asg"
+    DiscoverECS = "ecs"
+    DiscoverENI = "eni"
+    DiscoverVPC = "vpc"
+)
+
+// Resources holds what a source discovers besides EC2 instances.
+type Resources struct {
+    Databases         []*RDSDatabase
+    LoadBalancers     []*LoadBalancer
+    AutoScalingGroups []*AutoScalingGroup
+    ECSClusters       []*ECSCluster
+    ECSTasks          []*ECSTask
+    Addresses         []*NetworkAddress
+    VPCs              []*VPC
+}
+
+// ResourceSource is implemented by sources that can list resources other
+// than EC2 instances.
+type ResourceSource interface {
+    ListResources(ctx context.Context) (error, *Resources)
+}
+
+func (r *Resources) merge(other *Resources) {
+    if other == nil {
+        return
+    }
+    r.Databases = append(r.Databases, other.Databases...)
+    r.LoadBalancers = append(r.LoadBalancers, other.LoadBalancers...)
+    r.AutoScalingGroups = append(r.AutoScalingGroups, other.AutoScalingGroups...)
+    r.ECSClusters = append(r.ECSClusters, other.ECSClusters...)
+    r.ECSTasks = append(r.ECSTasks, other.ECSTasks...)
+    r.Addresses = append(r.Addresses, other.Addresses...)
+    r.VPCs = append(r.VPCs, other.VPCs...)
+}
@@ -0,0 +1,129 @@
+package aws
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+
+    "github.com/aws/aws-sdk-go/aws"
+)
+
+// stubSource lists fixed instances and fails listing resources.
+type stubSource struct {
+    instances []*EC2Instance
+}
+
+func (s *stubSource) ListInstances(ctx context.Context) (error, []*EC2Instance) {
+    instances := make([]*EC2Instance, 0, len(s.instances))
+    for _, inst := range s.instances {
+        copied := *inst
+        instances = append(instances, &copied)
+    }
+    return nil, instances
+}
+
+func (s *stubSource) ListResources(ctx context.Context) (error, *Resources) {
+    return errors.New("AccessDenied: rds:DescribeDBInstances"), nil
+}
+
+func TestResourceFailureDoesNotFailRefresh(t *testing.T) {
+    s := NewService(Config{RefreshInterval: "1h"})
+    s.Source = &stubSource{instances: []*EC2Instance{{ID: "i-1", Name: "web", State: "running", PrivateIP: "10.0.1.10"}}}
+    if err := s.Open(); err != nil {
+        t.Fatalf("open failed on a resource error: %s", err.Error())
+    }
+    defer s.Close()
+    if err := s.UpdateCache(); err != nil {
+        t.Fatalf("refresh failed on a resource error: %s", err.Error())
+    }
+    health := s.Health()
+    if health.Stale || health.LastSuccess.IsZero() || health.ConsecutiveFailures != 0 {
+        t.Errorf("unexpected health: %+v", health)
+    }
+    if instances := s.GetEC2FromName("web"); len(instances) != 1 {
+        t.Errorf("web: %+v", instances)
+    }
+}
+
+// fakeDescribe is a local stand-in for the EC2 and RDS query APIs that
+// answers DescribeVpcs and the RDS listings, failing RDS on demand.
+type fakeDescribe struct {
+    mu      sync.Mutex
+    failRDS bool
+    failVPC bool
+    vpcID   string
+}
+
+func (f *fakeDescribe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    r.ParseForm()
+    action := r.Form.Get("Action")
+    fail := (action == "DescribeVpcs" && f.failVPC) || (action != "DescribeVpcs" && f.failRDS)
+    w.Header().Set("Content-Type", "text/xml")
+    if fail && action == "DescribeVpcs" {
+        w.WriteHeader(403)
+        w.Write([]byte(`<Response><Errors><Error><Code>UnauthorizedOperation</Code><Message>denied</Message></Error></Errors><RequestID>1</RequestID></Response>`))
+        return
+    }
+    if fail {
+        w.WriteHeader(403)
+        w.Write([]byte(`<ErrorResponse><Error><Code>AccessDenied</Code><Message>denied</Message></Error><RequestId>1</RequestId></ErrorResponse>`))
+        return
+    }
+    switch action {
+    case "DescribeVpcs":
+        w.Write([]byte(`<DescribeVpcsResponse><vpcSet><item><vpcId>` + f.vpcID + `</vpcId><cidrBlock>10.0.0.0/16</cidrBlock></item></vpcSet></DescribeVpcsResponse>`))
+    case "DescribeDBInstances":
+        w.Write([]byte(`<DescribeDBInstancesResponse><DescribeDBInstancesResult><DBInstances><DBInstance><DBInstanceIdentifier>orders</DBInstanceIdentifier></DBInstance></DBInstances></DescribeDBInstancesResult></DescribeDBInstancesResponse>`))
+    case "DescribeDBClusters":
+        w.Write([]byte(`<DescribeDBClustersResponse><DescribeDBClustersResult><DBClusters></DBClusters></DescribeDBClustersResult></DescribeDBClustersResponse>`))
+    default:
+        w.WriteHeader(400)
+    }
+}
+
+func (f *fakeDescribe) set(failRDS bool, failVPC bool, vpcID string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.failRDS, f.failVPC, f.vpcID = failRDS, failVPC, vpcID
+}
+
+func TestEC2SourceKeepsKindsThatSucceeded(t *testing.T) {
+    fake := &fakeDescribe{vpcID: "vpc-1"}
+    server := httptest.NewServer(fake)
+    defer server.Close()
+
+    sc := &SourceConfig{Account: "123456789012", AccessKeyID: "test", SecretAccessKey: "test", Discover: "rds,vpc"}
+    err, sess := newSession("test", "us-east-1", sc)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sess.Config.Endpoint = aws.String(server.URL)
+    source := NewEC2Source("test", "us-east-1", sess, sc, &Config{})
+
+    err, resources := source.ListResources(context.Background())
+    if err != nil || len(resources.Databases) != 1 || len(resources.VPCs) != 1 {
+        t.Fatalf("first listing: %+v, %v", resources, err)
+    }
+
+    fake.set(true, false, "vpc-2")
+    err, resources = source.ListResources(context.Background())
+    if err != nil {
+        t.Fatalf("listing with rds denied: %s", err.Error())
+    }
+    if len(resources.Databases) != 1 || resources.Databases[0].ID != "orders" {
+        t.Errorf("previous databases not kept: %+v", resources.Databases)
+    }
+    if len(resources.VPCs) != 1 || resources.VPCs[0].ID != "vpc-2" {
+        t.Errorf("vpcs not refreshed: %+v", resources.VPCs)
+    }
+
+    fake.set(true, true, "vpc-3")
+    if err, _ := source.ListResources(context.Background()); err == nil {
+        t.Error("listing succeeded with every kind failing")
+    }
+}
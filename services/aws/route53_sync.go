@@ -0,0 +1,388 @@
+package aws
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/route53"
+)
+
+const (
+    route53BatchSize    = 100
+    route53SyncTimeout  = 5 * time.Minute
+    defaultRoute53Ttl   = 60
+    defaultRoute53Owner = "aws-meta-server"
+    route53Region       = "us-east-1"
+)
+
+// ZoneChange is one change the sync applies, or would apply in dry-run
+// mode, to the hosted zone.
+type ZoneChange struct {
+    Action string
+    Name   string
+    Type   string
+    TTL    int64
+    Values []string
+}
+
+// ZoneSync reconciles instance names into a Route 53 hosted zone, for
+// clients that can only use the VPC resolver. Every record set it creates
+// gets a TXT marker naming the owner, and it never touches names without
+// one. Route53Endpoint points it at a local Route 53 stand-in.
+type ZoneSync struct {
+    ZoneID  string
+    Domain  string
+    DryRun  bool
+    client  *route53.Route53
+    service *Service
+    ttl     int64
+    marker  string
+    logger  *log.Logger
+    notify  chan struct{}
+    cancel  context.CancelFunc
+    done    chan struct{}
+}
+
+func NewZoneSync(c *Config, service *Service) (error, *ZoneSync) {
+    if c.Route53Domain == "" {
+        return fmt.Errorf("Route53Domain is required with Route53ZoneID"), nil
+    }
+    err, sess := newSession("route53", route53Region, c.defaultSource())
+    if err != nil {
+        return err, nil
+    }
+    clientConfig := aws.NewConfig()
+    if c.Route53Endpoint != "" {
+        clientConfig = clientConfig.WithEndpoint(c.Route53Endpoint)
+    }
+    ttl := c.Route53Ttl
+    if ttl <= 0 {
+        ttl = defaultRoute53Ttl
+    }
+    owner := c.Route53Owner
+    if owner == "" {
+        owner = defaultRoute53Owner
+    }
+    return nil, &ZoneSync{
+        ZoneID: c.Route53ZoneID,
+        Domain: normalizeDNSName(c.Route53Domain) + ".",
+        DryRun: c.Route53DryRun,
+        client: route53.New(sess, clientConfig),
+        service: service,
+        ttl: int64(ttl),
+        marker: fmt.Sprintf("\"heritage=aws-meta-server,owner=%s\"", owner),
+        logger: log.New(os.Stderr, "[aws] ", log.LstdFlags),
+    }
+}
+
+func (z *ZoneSync) Start() {
+    ctx, cancel := context.WithCancel(context.Background())
+    z.cancel = cancel
+    z.notify = make(chan struct{}, 1)
+    z.done = make(chan struct{})
+    go z.run(ctx)
+}
+
+func (z *ZoneSync) Stop() {
+    if z.cancel == nil {
+        return
+    }
+    z.cancel()
+    <-z.done
+    z.cancel = nil
+}
+
+// Notify asks for a sync after the cache changed. Notifications arriving
+// while a sync runs collapse into a single follow-up sync.
+func (z *ZoneSync) Notify() {
+    if z.notify == nil {
+        return
+    }
+    select {
+    case z.notify <- struct{}{}:
+    default:
+    }
+}
+
+func (z *ZoneSync) run(ctx context.Context) {
+    defer close(z.done)
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-z.notify:
+        }
+        syncCtx, cancel := context.WithTimeout(ctx, route53SyncTimeout)
+        err, changes := z.Sync(syncCtx)
+        cancel()
+        if err != nil {
+            if ctx.Err() != nil {
+                return
+            }
+            z.logger.Printf("%s: sync failed: %s", z, credentialsError(z, err).Error())
+        } else if len(changes) > 0 {
+            z.logger.Printf("%s: %d record changes", z, len(changes))
+        }
+    }
+}
+
+// Sync computes the changes the zone needs and applies them in batches,
+// or only logs them in dry-run mode.
+func (z *ZoneSync) Sync(ctx context.Context) (error, []ZoneChange) {
+    err, changes := z.Plan(ctx)
+    if err != nil {
+        return err, nil
+    }
+    if z.DryRun {
+        for _, change := range changes {
+            z.logger.Printf("%s: dry run: %s %s %s %s", z, change.Action, change.Type, change.Name, strings.Join(change.Values, " "))
+        }
+        return nil, changes
+    }
+    applied := 0
+    for _, batch := range batchChanges(changes, route53BatchSize) {
+        if err := z.apply(ctx, batch); err != nil {
+            return err, changes[:applied]
+        }
+        applied += len(batch)
+    }
+    return nil, changes
+}
+
+// batchChanges splits changes into batches of at most size changes, never
+// splitting the changes to one name, so an A record and its marker are
+// always created or deleted together.
+func batchChanges(changes []ZoneChange, size int) [][]ZoneChange {
+    var batches [][]ZoneChange
+    var batch []ZoneChange
+    for start := 0; start < len(changes); {
+        end := start + 1
+        for end < len(changes) && normalizeDNSName(changes[end].Name) == normalizeDNSName(changes[start].Name) {
+            end++
+        }
+        if len(batch) > 0 && len(batch) + end - start > size {
+            batches = append(batches, batch)
+            batch = nil
+        }
+        batch = append(batch, changes[start:end]...)
+        start = end
+    }
+    if len(batch) > 0 {
+        batches = append(batches, batch)
+    }
+    return batches
+}
+
+// zoneName is what the zone holds at one name: the A record and the TXT
+// marker this server manages there, and whether a record set stands in the
+// way of the A record.
+type zoneName struct {
+    address  *route53.ResourceRecordSet
+    marker   *route53.ResourceRecordSet
+    conflict bool
+}
+
+// Plan diffs the names the server answers for against the record sets the
+// zone holds. Names holding any record set without our TXT marker belong to
+// someone else, and owned names where a CNAME or a routed or alias A record
+// took the place of ours are conflicting; both are skipped.
+func (z *ZoneSync) Plan(ctx context.Context) (error, []ZoneChange) {
+    desired := z.desiredRecords()
+    zone := make(map[string]*zoneName)
+    err := z.client.ListResourceRecordSetsPagesWithContext(ctx, &route53.ListResourceRecordSetsInput{
+        HostedZoneId: aws.String(z.ZoneID),
+    }, func(page *route53.ListResourceRecordSetsOutput, lastPage bool) bool {
+        for _, set := range page.ResourceRecordSets {
+            name := normalizeDNSName(aws.StringValue(set.Name)) + "."
+            entry, ok := zone[name]
+            if !ok {
+                entry = &zoneName{}
+                zone[name] = entry
+            }
+            simple := set.SetIdentifier == nil && set.AliasTarget == nil
+            switch aws.StringValue(set.Type) {
+            case route53.RRTypeA:
+                if simple {
+                    entry.address = set
+                } else {
+                    entry.conflict = true
+                }
+            case route53.RRTypeCname:
+                entry.conflict = true
+            case route53.RRTypeTxt:
+                if simple && z.isMarker(set) {
+                    entry.marker = set
+                }
+            }
+        }
+        return true
+    })
+    if err != nil {
+        return err, nil
+    }
+
+    var changes []ZoneChange
+    names := make([]string, 0, len(desired))
+    for name := range desired {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        values := desired[name]
+        entry, exists := zone[name]
+        switch {
+        case !exists:
+            changes = append(changes,
+                z.change(route53.ChangeActionCreate, name, route53.RRTypeA, values),
+                z.change(route53.ChangeActionCreate, name, route53.RRTypeTxt, []string{z.marker}))
+        case entry.marker == nil:
+            z.logger.Printf("%s: %s holds records not owned by this server, skipping", z, name)
+        case entry.conflict:
+            z.logger.Printf("%s: %s holds records conflicting with its A record, skipping", z, name)
+        case entry.address == nil:
+            changes = append(changes, z.change(route53.ChangeActionCreate, name, route53.RRTypeA, values))
+        case !sameValues(recordValues(entry.address), values) || aws.Int64Value(entry.address.TTL) != z.ttl:
+            changes = append(changes, z.change(route53.ChangeActionUpsert, name, route53.RRTypeA, values))
+        }
+    }
+    var stale []string
+    for name, entry := range zone {
+        if _, ok := desired[name]; !ok && entry.marker != nil {
+            stale = append(stale, name)
+        }
+    }
+    sort.Strings(stale)
+    for _, name := range stale {
+        // Deletes have to repeat the record set exactly as it is.
+        entry := zone[name]
+        if entry.address != nil {
+            changes = append(changes, deleteChange(entry.address))
+        }
+        changes = append(changes, deleteChange(entry.marker))
+    }
+    return nil, changes
+}
+
+// isMarker reports whether a TXT record set carries this server's marker.
+func (z *ZoneSync) isMarker(set *route53.ResourceRecordSet) bool {
+    for _, value := range recordValues(set) {
+        if value == z.marker {
+            return true
+        }
+    }
+    return false
+}
+
+func (z *ZoneSync) change(action string, name string, rrtype string, values []string) ZoneChange {
+    return ZoneChange{
+        Action: action,
+        Name: name,
+        Type: rrtype,
+        TTL: z.ttl,
+        Values: values,
+    }
+}
+
+func deleteChange(set *route53.ResourceRecordSet) ZoneChange {
+    return ZoneChange{
+        Action: route53.ChangeActionDelete,
+        Name: aws.StringValue(set.Name),
+        Type: aws.StringValue(set.Type),
+        TTL: aws.Int64Value(set.TTL),
+        Values: recordValues(set),
+    }
+}
+
+// desiredRecords maps every instance hostname that is a valid DNS name to
+// the private addresses it resolves to, honouring the duplicate policy.
+func (z *ZoneSync) desiredRecords() map[string][]string {
+    records := make(map[string][]string)
+    inv := z.service.inventory()
+    // Publish every name DNS answers, the unique ones such as "web-2"
+    // given to instances sharing a name included.
+    names := make([]string, 0, len(inv.byName) + len(inv.byUnique))
+    for name := range inv.byName {
+        names = append(names, name)
+    }
+    for name := range inv.byUnique {
+        names = append(names, name)
+    }
+    for _, name := range names {
+        if name == "" || sanitizeHostname(name) != name {
+            continue
+        }
+        err, instances := z.service.ResolveEC2Name(name, Scope{})
+        if err != nil {
+            continue
+        }
+        seen := make(map[string]bool)
+        var values []string
+        for _, inst := range instances {
+            if inst.PrivateIP != "" && !seen[inst.PrivateIP] {
+                seen[inst.PrivateIP] = true
+                values = append(values, inst.PrivateIP)
+            }
+        }
+        if len(values) > 0 {
+            sort.Strings(values)
+            records[name + "." + z.Domain] = values
+        }
+    }
+    return records
+}
+
+func (z *ZoneSync) apply(ctx context.Context, changes []ZoneChange) error {
+    batch := &route53.ChangeBatch{
+        Comment: aws.String("aws-meta-server sync"),
+    }
+    for _, change := range changes {
+        set := &route53.ResourceRecordSet{
+            Name: aws.String(change.Name),
+            Type: aws.String(change.Type),
+            TTL: aws.Int64(change.TTL),
+        }
+        for _, value := range change.Values {
+            set.ResourceRecords = append(set.ResourceRecords, &route53.ResourceRecord{Value: aws.String(value)})
+        }
+        batch.Changes = append(batch.Changes, &route53.Change{
+            Action: aws.String(change.Action),
+            ResourceRecordSet: set,
+        })
+    }
+    _, err := z.client.ChangeResourceRecordSetsWithContext(ctx, &route53.ChangeResourceRecordSetsInput{
+        HostedZoneId: aws.String(z.ZoneID),
+        ChangeBatch: batch,
+    })
+    return err
+}
+
+func (z *ZoneSync) String() string {
+    return "route53/" + z.ZoneID
+}
+
+func recordValues(set *route53.ResourceRecordSet) []string {
+    values := make([]string, 0, len(set.ResourceRecords))
+    for _, record := range set.ResourceRecords {
+        values = append(values, aws.StringValue(record.Value))
+    }
+    sort.Strings(values)
+    return values
+}
+
+func sameValues(a []string, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,251 @@
+package aws
+
+import (
+    "context"
+    "encoding/xml"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "sort"
+    "strings"
+    "sync"
+    "testing"
+)
+
+type fakeRecordSet struct {
+    Name          string
+    Type          string
+    SetIdentifier string   `xml:",omitempty"`
+    TTL           int64
+    Values        []string `xml:"ResourceRecords>ResourceRecord>Value"`
+}
+
+// fakeWireSet is fakeRecordSet as Route 53 lists it, each value in a
+// ResourceRecord of its own.
+type fakeWireSet struct {
+    Name          string
+    Type          string
+    SetIdentifier string `xml:",omitempty"`
+    TTL           int64
+    Records       []struct {
+        Value string
+    } `xml:"ResourceRecords>ResourceRecord"`
+}
+
+func (set fakeRecordSet) key() string {
+    return set.Name + "|" + set.Type + "|" + set.SetIdentifier
+}
+
+// fakeZone is a local stand-in for the Route 53 REST API serving one
+// hosted zone. Like Route 53 it applies a change batch all or nothing and
+// rejects creating a set that exists, anything next to a CNAME, and
+// deletes that do not repeat the set exactly.
+type fakeZone struct {
+    mu      sync.Mutex
+    sets    map[string]fakeRecordSet
+    batches [][]string
+}
+
+func newFakeZone(sets ...fakeRecordSet) *fakeZone {
+    z := &fakeZone{sets: make(map[string]fakeRecordSet)}
+    for _, set := range sets {
+        z.sets[set.key()] = set
+    }
+    return z
+}
+
+func (z *fakeZone) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    z.mu.Lock()
+    defer z.mu.Unlock()
+    w.Header().Set("Content-Type", "text/xml")
+    if r.Method == "GET" {
+        response := struct {
+            XMLName     xml.Name        `xml:"ListResourceRecordSetsResponse"`
+            Sets        []fakeWireSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+            IsTruncated bool
+            MaxItems    string
+        }{MaxItems: "300"}
+        keys := make([]string, 0, len(z.sets))
+        for key := range z.sets {
+            keys = append(keys, key)
+        }
+        sort.Strings(keys)
+        for _, key := range keys {
+            set := z.sets[key]
+            wire := fakeWireSet{Name: set.Name, Type: set.Type, SetIdentifier: set.SetIdentifier, TTL: set.TTL}
+            for _, value := range set.Values {
+                wire.Records = append(wire.Records, struct{ Value string }{value})
+            }
+            response.Sets = append(response.Sets, wire)
+        }
+        xml.NewEncoder(w).Encode(response)
+        return
+    }
+    var request struct {
+        Changes []struct {
+            Action string
+            Set    fakeRecordSet `xml:"ResourceRecordSet"`
+        } `xml:"ChangeBatch>Changes>Change"`
+    }
+    if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+        w.WriteHeader(400)
+        return
+    }
+    sets := make(map[string]fakeRecordSet, len(z.sets))
+    for key, set := range z.sets {
+        sets[key] = set
+    }
+    var batch []string
+    for _, change := range request.Changes {
+        set := change.Set
+        batch = append(batch, change.Action + " " + set.Type + " " + set.Name)
+        current, exists := sets[set.key()]
+        var err string
+        switch change.Action {
+        case "CREATE":
+            if exists {
+                err = "already exists"
+            }
+            for _, other := range sets {
+                if other.Name == set.Name && (other.Type == "CNAME") != (set.Type == "CNAME") {
+                    err = "conflicts with a CNAME"
+                }
+            }
+            sets[set.key()] = set
+        case "UPSERT":
+            sets[set.key()] = set
+        case "DELETE":
+            if !exists || fmt.Sprint(current) != fmt.Sprint(set) {
+                err = "not found"
+            }
+            delete(sets, set.key())
+        }
+        if err != "" {
+            w.WriteHeader(400)
+            fmt.Fprintf(w, "<InvalidChangeBatch><Messages><Message>%s %s %s: %s</Message></Messages><RequestId>1</RequestId></InvalidChangeBatch>", change.Action, set.Type, set.Name, err)
+            return
+        }
+    }
+    z.sets = sets
+    z.batches = append(z.batches, batch)
+    w.Write([]byte(`<ChangeResourceRecordSetsResponse><ChangeInfo><Id>/change/C1</Id><Status>PENDING</Status><SubmittedAt>2024-01-01T00:00:00Z</SubmittedAt></ChangeInfo></ChangeResourceRecordSetsResponse>`))
+}
+
+// values returns the values of a simple record set, or nil without one.
+func (z *fakeZone) values(name string, rrtype string) []string {
+    z.mu.Lock()
+    defer z.mu.Unlock()
+    return z.sets[name + "|" + rrtype + "|"].Values
+}
+
+const zoneInventory = `{
+    "instances": [
+        {"ID": "i-1", "Name": "web", "State": "running", "PrivateIP": "10.0.1.10"},
+        {"ID": "i-2", "Name": "db", "State": "running", "PrivateIP": "10.0.2.20"},
+        {"ID": "i-3", "Name": "app", "State": "running", "PrivateIP": "10.0.3.30"},
+        {"ID": "i-4", "Name": "cache", "State": "running", "PrivateIP": "10.0.4.40"},
+        {"ID": "i-5", "Name": "queue", "State": "running", "PrivateIP": "10.0.5.50"},
+        {"ID": "i-6", "Name": "api", "State": "running", "PrivateIP": "10.0.6.60"},
+        {"ID": "i-7", "Name": "api", "State": "running", "PrivateIP": "10.0.6.61"},
+        {"ID": "i-8", "Name": "batch", "State": "running", "PrivateIP": "10.0.8.80", "Account": "111111111111"},
+        {"ID": "i-9", "Name": "batch", "State": "running", "PrivateIP": "10.0.8.80", "Account": "222222222222"}
+    ]
+}`
+
+func TestZoneSync(t *testing.T) {
+    s, _ := newTestService(t, Config{UniqueNames: UniqueNamesIndex}, zoneInventory)
+    marker := "\"heritage=aws-meta-server,owner=test\""
+    zone := newFakeZone(
+        // Someone else's TXT and CNAME, which a create would collide with.
+        fakeRecordSet{Name: "db.example.com.", Type: "TXT", TTL: 300, Values: []string{"\"v=spf1 -all\""}},
+        fakeRecordSet{Name: "app.example.com.", Type: "CNAME", TTL: 300, Values: []string{"app.elsewhere.com."}},
+        // Ours, with an old address.
+        fakeRecordSet{Name: "cache.example.com.", Type: "A", TTL: 60, Values: []string{"10.9.9.9"}},
+        fakeRecordSet{Name: "cache.example.com.", Type: "TXT", TTL: 60, Values: []string{marker}},
+        // Ours, with a weighted A record added beside the marker since.
+        fakeRecordSet{Name: "queue.example.com.", Type: "A", SetIdentifier: "blue", TTL: 60, Values: []string{"10.0.5.51"}},
+        fakeRecordSet{Name: "queue.example.com.", Type: "TXT", TTL: 60, Values: []string{marker}},
+        // Ours, for an instance that is gone.
+        fakeRecordSet{Name: "old.example.com.", Type: "A", TTL: 60, Values: []string{"10.0.9.9"}},
+        fakeRecordSet{Name: "old.example.com.", Type: "TXT", TTL: 60, Values: []string{marker}},
+    )
+    server := httptest.NewServer(zone)
+    defer server.Close()
+
+    err, sync := NewZoneSync(&Config{
+        AccessKeyID: "test",
+        SecretAccessKey: "test",
+        Route53ZoneID: "Z1",
+        Route53Domain: "example.com",
+        Route53Endpoint: server.URL,
+        Route53Owner: "test",
+    }, s)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err, changes := sync.Sync(context.Background())
+    if err != nil {
+        t.Fatalf("sync: %s", err.Error())
+    }
+    if len(changes) != 17 {
+        t.Errorf("changes: %+v", changes)
+    }
+    for _, test := range []struct {
+        name   string
+        rrtype string
+        values []string
+    }{
+        {"web.example.com.", "A", []string{"10.0.1.10"}},
+        {"web.example.com.", "TXT", []string{marker}},
+        {"cache.example.com.", "A", []string{"10.0.4.40"}},
+        {"db.example.com.", "TXT", []string{"\"v=spf1 -all\""}},
+        {"db.example.com.", "A", nil},
+        {"app.example.com.", "A", nil},
+        {"queue.example.com.", "A", nil},
+        {"old.example.com.", "A", nil},
+        {"old.example.com.", "TXT", nil},
+        // Shared names and the unique names DNS gives each instance.
+        {"api.example.com.", "A", []string{"10.0.6.60", "10.0.6.61"}},
+        {"api-1.example.com.", "A", []string{"10.0.6.60"}},
+        {"api-1.example.com.", "TXT", []string{marker}},
+        {"api-2.example.com.", "A", []string{"10.0.6.61"}},
+        // Instances in different accounts may share an address.
+        {"batch.example.com.", "A", []string{"10.0.8.80"}},
+        {"batch-2.example.com.", "A", []string{"10.0.8.80"}},
+    } {
+        if values := zone.values(test.name, test.rrtype); strings.Join(values, ",") != strings.Join(test.values, ",") {
+            t.Errorf("%s %s: %v, want %v", test.rrtype, test.name, values, test.values)
+        }
+    }
+
+    if err, changes := sync.Sync(context.Background()); err != nil || len(changes) != 0 {
+        t.Errorf("second sync: %+v, %v", changes, err)
+    }
+}
+
+func TestBatchChangesKeepsNamesTogether(t *testing.T) {
+    var changes []ZoneChange
+    for _, name := range []string{"a", "b", "c", "d"} {
+        changes = append(changes,
+            ZoneChange{Action: "CREATE", Name: name + ".example.com.", Type: "A"},
+            ZoneChange{Action: "CREATE", Name: name + ".example.com.", Type: "TXT"})
+    }
+    changes = append(changes, ZoneChange{Action: "UPSERT", Name: "e.example.com.", Type: "A"})
+
+    batches := batchChanges(changes, 3)
+    var sizes []string
+    total := 0
+    for _, batch := range batches {
+        sizes = append(sizes, fmt.Sprint(len(batch)))
+        total += len(batch)
+        for i := 0; i < len(batch); i += 2 {
+            if batch[i].Type == "A" && batch[i].Action == "CREATE" && (i + 1 >= len(batch) || batch[i + 1].Name != batch[i].Name) {
+                t.Errorf("%s split from its marker: %+v", batch[i].Name, batch)
+            }
+        }
+    }
+    if strings.Join(sizes, ",") != "2,2,2,3" || total != len(changes) {
+        t.Errorf("batch sizes %v", sizes)
+    }
+}
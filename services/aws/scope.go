@@ -0,0 +1,29 @@
+package aws
+
+// Scope narrows lookups to instances from a given source, account or
+// region. Empty fields match everything. States, when set, replaces the
+// configured state policy, which makes the lookup scan every instance
+// rather than use the indexes.
+type Scope struct {
+    Source  string
+    Account string
+    Region  string
+    States  StatePolicy
+}
+
+func (sc Scope) IsEmpty() bool {
+    return sc.Source == "" && sc.Account == "" && sc.Region == "" && sc.States == nil
+}
+
+func (sc Scope) Match(inst *EC2Instance) bool {
+    return (sc.States == nil || sc.States.Allow(inst.State)) &&
+        sc.matchResource(inst.Source, inst.Account, inst.Region)
+}
+
+// matchResource applies the scope to resources other than instances, which
+// have no state policy.
+func (sc Scope) matchResource(source string, account string, region string) bool {
+    return (sc.Source == "" || sc.Source == source) &&
+        (sc.Account == "" || sc.Account == account) &&
+        (sc.Region == "" || sc.Region == region)
+}
@@ -0,0 +1,169 @@
+package aws
+
+import (
+    "fmt"
+    "strings"
+)
+
+const (
+    selectorExists    = "exists"
+    selectorNotExists = "!exists"
+    selectorEquals    = "="
+    selectorNotEquals = "!="
+    selectorIn        = "in"
+    selectorNotIn     = "notin"
+
+    selectorFieldPrefix = "@"
+)
+
+// Selector is a parsed tag selector, a comma separated list of terms that
+// must all match:
+//   Role=web         tag equals value
+//   Role!=web        tag missing or different
+//   Role in (a,b)    tag equals one of the values
+//   Role notin (a,b) tag missing or none of the values
+//   Role, !Role      tag present, tag missing
+// Keys starting with "@" name instance fields instead of tags: @state, @name,
+// @id, @az, @region, @account, @source, @type, @vpc and @subnet.
+type Selector []selectorTerm
+
+type selectorTerm struct {
+    key    string
+    op     string
+    values []string
+}
+
+func ParseSelector(expr string) (error, Selector) {
+    var selector Selector
+    for _, term := range splitSelector(expr) {
+        term = strings.TrimSpace(term)
+        if term == "" {
+            continue
+        }
+        err, parsed := parseSelectorTerm(term)
+        if err != nil {
+            return err, nil
+        }
+        if !parsed.validKey() {
+            return fmt.Errorf("bad selector term %q: unknown key %q", term, parsed.key), nil
+        }
+        selector = append(selector, parsed)
+    }
+    return nil, selector
+}
+
+// splitSelector splits on commas outside of parentheses.
+func splitSelector(expr string) []string {
+    var terms []string
+    depth, start := 0, 0
+    for i, r := range expr {
+        switch r {
+        case '(':
+            depth++
+        case ')':
+            depth--
+        case ',':
+            if depth == 0 {
+                terms = append(terms, expr[start:i])
+                start = i + 1
+            }
+        }
+    }
+    return append(terms, expr[start:])
+}
+
+func parseSelectorTerm(term string) (error, selectorTerm) {
+    if open := strings.Index(term, "("); open >= 0 {
+        if !strings.HasSuffix(term, ")") {
+            return fmt.Errorf("bad selector term %q: unclosed value list", term), selectorTerm{}
+        }
+        fields := strings.Fields(term[:open])
+        if len(fields) != 2 || (fields[1] != selectorIn && fields[1] != selectorNotIn) {
+            return fmt.Errorf("bad selector term %q: expected \"key in (a,b)\"", term), selectorTerm{}
+        }
+        var values []string
+        for _, value := range strings.Split(term[open + 1:len(term) - 1], ",") {
+            values = append(values, strings.TrimSpace(value))
+        }
+        return nil, selectorTerm{key: fields[0], op: fields[1], values: values}
+    }
+    for _, op := range []string{selectorNotEquals, "==", selectorEquals} {
+        if idx := strings.Index(term, op); idx >= 0 {
+            key := strings.TrimSpace(term[:idx])
+            if key == "" {
+                return fmt.Errorf("bad selector term %q: missing key", term), selectorTerm{}
+            }
+            if op == "==" {
+                op = selectorEquals
+            }
+            return nil, selectorTerm{key: key, op: op, values: []string{strings.TrimSpace(term[idx + len(op):])}}
+        }
+    }
+    if strings.HasPrefix(term, "!") {
+        return nil, selectorTerm{key: strings.TrimSpace(term[1:]), op: selectorNotExists}
+    }
+    return nil, selectorTerm{key: term, op: selectorExists}
+}
+
+// Match reports whether the instance satisfies every term, an empty
+// selector matches everything.
+func (sel Selector) Match(inst *EC2Instance) bool {
+    for _, term := range sel {
+        if !term.match(inst) {
+            return false
+        }
+    }
+    return true
+}
+
+func (t selectorTerm) match(inst *EC2Instance) bool {
+    value, ok := t.lookup(inst)
+    switch t.op {
+    case selectorExists:
+        return ok
+    case selectorNotExists:
+        return !ok
+    case selectorEquals:
+        return ok && value == t.values[0]
+    case selectorNotEquals:
+        return !ok || value != t.values[0]
+    case selectorIn, selectorNotIn:
+        found := false
+        for _, candidate := range t.values {
+            if ok && value == candidate {
+                found = true
+                break
+            }
+        }
+        return found == (t.op == selectorIn)
+    }
+    return false
+}
+
+func (t selectorTerm) validKey() bool {
+    if t.key == "" {
+        return false
+    }
+    if !strings.HasPrefix(t.key, selectorFieldPrefix) {
+        return true
+    }
+    field := strings.TrimPrefix(t.key, selectorFieldPrefix)
+    _, ok := nameFields[field]
+    return ok || field == "state"
+}
+
+func (t selectorTerm) lookup(inst *EC2Instance) (string, bool) {
+    if !strings.HasPrefix(t.key, selectorFieldPrefix) {
+        value, ok := inst.Tags[t.key]
+        return value, ok
+    }
+    field := strings.TrimPrefix(t.key, selectorFieldPrefix)
+    if field == "state" {
+        return inst.State, inst.State != ""
+    }
+    if fieldFunc, ok := nameFields[field]; ok {
+        value := fieldFunc(inst)
+        return value, value != ""
+    }
+    return "", false
+}
@@ -1,32 +1,57 @@
 package aws
 import (
+    "context"
     "errors"
+    "fmt"
     "os"
     "log"
-
-    "github.com/aws/aws-sdk-go/aws"
-    "github.com/aws/aws-sdk-go/service/ec2"
-    "github.com/aws/aws-sdk-go/aws/credentials"
-    "github.com/aws/aws-sdk-go/aws/session"
+    "strings"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
 type Service struct {
-    Config       *Config
-    logger       *log.Logger
-    awsConfig    *aws.Config
-    updateTicker *time.Ticker
-    ec2Instances []*EC2Instance
+    Config        *Config
+    Source        InventorySource
+    statePolicy   StatePolicy
+    refreshPolicy refreshPolicy
+    namingPolicy  namingPolicy
+    refreshState  refreshState
+    logger        *log.Logger
+    stop          chan struct{}
+    events        *EventPoller
+    zoneSync      *ZoneSync
+    updateMu      sync.Mutex
+    applied       []instanceUpdate
+    cache         atomic.Value
+    listenersMu   sync.Mutex
+    listeners     []chan struct{}
 }
 
 type EC2Instance struct {
-    Address    string
-    PublicIP   string
-    PrivateIP  string
-    PubicDNS   string
-    PrivateDNS string
-    Name       string
-    UpdateTime time.Time
+    ID               string
+    Source           string
+    Account          string
+    Region           string
+    Address          string
+    PublicIP         string
+    PrivateIP        string
+    PublicDNS        string
+    PrivateDNS       string
+    Name             string
+    State            string
+    LaunchTime       time.Time
+    AvailabilityZone string
+    InstanceType     string
+    VpcID            string
+    SubnetID         string
+    SecurityGroups   []string
+    Tags             map[string]string
+    Hostnames        []string
+    PrivateIPs       []string
+    IPv6Addresses    []string
+    UpdateTime       time.Time
 }
 
 var (
@@ -34,111 +59,477 @@ var (
 )
 
 func NewService(c Config) *Service {
-    awsConfig := aws.NewConfig().WithCredentials(
-        credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey, "")).WithRegion(c.Region)
     s := &Service{
         Config: &c,
         logger: log.New(os.Stderr, "[aws] ", log.LstdFlags),
-        awsConfig: awsConfig,
     }
     return s
 }
 
 func (s *Service) Open() error {
-    err := s.UpdateCache()
-    s.updateTicker = time.NewTicker(30 * time.Second)
-    go func() {
-        for range s.updateTicker.C {
-            s.UpdateCache()
+    states := s.Config.InstanceStates
+    if states == "" {
+        states = defaultStates
+    }
+    err, statePolicy := ParseStatePolicy(states)
+    if err != nil {
+        return fmt.Errorf("bad InstanceStates: %s", err.Error())
+    }
+    s.statePolicy = statePolicy
+    err, policy := newRefreshPolicy(s.Config)
+    if err != nil {
+        return err
+    }
+    s.refreshPolicy = policy
+    err, naming := newNamingPolicy(s.Config)
+    if err != nil {
+        return err
+    }
+    s.namingPolicy = naming
+    snapshotInterval := defaultSnapshotInterval
+    if err := parseDuration("SnapshotInterval", s.Config.SnapshotInterval, &snapshotInterval); err != nil {
+        return err
+    }
+    if snapshotInterval <= 0 {
+        return fmt.Errorf("SnapshotInterval must be positive")
+    }
+    if s.Source == nil {
+        err, source := newInventorySource(s.Config)
+        if err != nil {
+            return err
+        }
+        s.Source = source
+    }
+    if s.Config.EventQueueURL != "" && s.events == nil {
+        err, poller := NewEventPoller(s.Config, s)
+        if err != nil {
+            return err
+        }
+        s.events = poller
+    }
+    if s.Config.Route53ZoneID != "" && s.zoneSync == nil {
+        err, zoneSync := NewZoneSync(s.Config, s)
+        if err != nil {
+            return err
         }
-    }()
+        s.zoneSync = zoneSync
+    }
+    if s.zoneSync != nil {
+        s.zoneSync.Start()
+    }
+    warm := false
+    if s.Config.SnapshotFile != "" {
+        if err := s.loadSnapshot(); err != nil {
+            s.logger.Printf("load snapshot failed: %s", err.Error())
+        } else {
+            warm = true
+        }
+    }
+    s.stop = make(chan struct{})
+    if warm {
+        // Answer from the snapshot while the first refresh runs.
+        err = nil
+        go s.refreshLoop(s.stop, true)
+    } else {
+        err = s.UpdateCache()
+        go s.refreshLoop(s.stop, false)
+    }
+    if s.Config.SnapshotFile != "" {
+        go s.snapshotLoop(s.stop, snapshotInterval)
+    }
+    if s.events != nil {
+        s.events.Start()
+    }
     return err;
 }
 
 func (s *Service) Close() error {
-    s.updateTicker.Stop()
-    s.updateTicker = nil
+    if s.stop != nil {
+        close(s.stop)
+        s.stop = nil
+    }
+    if s.events != nil {
+        s.events.Stop()
+    }
+    if s.zoneSync != nil {
+        s.zoneSync.Stop()
+    }
+    if s.Config.SnapshotFile != "" && s.inventory() != emptyInventory {
+        if err := s.saveSnapshot(); err != nil {
+            return err
+        }
+    }
     return nil;
 }
 
 func (s *Service) GetAllEC2Names() []string {
-    names := make([]string, 0, len(s.ec2Instances));
-    s.eachEC2Instance(func(idx int, instance *EC2Instance) bool {
-        names = append(names, instance.Name)
-        return true
-    })
+    return s.GetEC2NamesInScope(Scope{})
+}
+
+func (s *Service) GetEC2NamesInScope(scope Scope) []string {
+    inv := s.inventory()
+    names := make([]string, 0, len(inv.instances));
+    for _, instance := range filterScope(inv.candidates(scope), scope, nil) {
+        names = append(names, instance.names()...)
+    }
     return names
 }
 
-func (s *Service) GetEC2FromName(name string) (instances []EC2Instance) {
-    s.eachEC2Instance(func(idx int, inst *EC2Instance) bool {
-        if inst.Name == name {
-            instances = append(instances, *inst)
+func (s *Service) GetEC2FromName(name string) []EC2Instance {
+    return s.GetEC2FromNameInScope(name, Scope{})
+}
+
+// GetEC2FromNameInScope returns the instances the duplicate name policy
+// answers with, none when the policy makes a shared name an error.
+func (s *Service) GetEC2FromNameInScope(name string, scope Scope) []EC2Instance {
+    _, instances := s.ResolveEC2Name(name, scope)
+    return instances
+}
+
+// ResolveEC2Name looks a name up like GetEC2FromNameInScope but reports
+// DuplicateNameError when the policy refuses to pick among instances.
+func (s *Service) ResolveEC2Name(name string, scope Scope) (error, []EC2Instance) {
+    inv := s.inventory()
+    err, selected := inv.naming.selectDuplicates(inv.findByName(name, scope))
+    if err != nil {
+        return err, nil
+    }
+    var instances []EC2Instance
+    for _, inst := range selected {
+        instances = append(instances, *inst)
+    }
+    return nil, instances
+}
+
+// GetNameConflicts reports the names shared by several instances.
+func (s *Service) GetNameConflicts(scope Scope) []NameConflict {
+    return s.inventory().conflictReport(scope)
+}
+
+// ResolveScopedName splits a name such as "web.us-east-1" into the instance
+// name and the scope named by its last label, when no instance is called
+// by the full name.
+func (s *Service) ResolveScopedName(name string) (string, Scope) {
+    inv := s.inventory()
+    if _, ok := inv.byName[strings.ToLower(name)]; ok {
+        return name, Scope{}
+    }
+    if _, ok := inv.byUnique[strings.ToLower(name)]; ok {
+        return name, Scope{}
+    }
+    idx := strings.LastIndex(name, ".")
+    if idx < 0 {
+        return name, Scope{}
+    }
+    if scope, ok := inv.scopeFromLabel(name[idx + 1:]); ok {
+        return name[:idx], scope
+    }
+    return name, Scope{}
+}
+
+// HasEC2NamesBelow reports whether instance names end in "."+name, which
+// makes name an empty non-terminal in DNS.
+func (s *Service) HasEC2NamesBelow(name string) bool {
+    return s.inventory().parents[strings.ToLower(name)]
+}
+
+// GetSRVTargets returns the instances listing name, such as "_http._tcp",
+// in their SRV tag, and whether the name exists, which it also does without
+// targets when listed names end in "."+name.
+func (s *Service) GetSRVTargets(name string) ([]SRVTarget, bool) {
+    srv := s.inventory().srv
+    name = strings.ToLower(name)
+    targets := srv.byName[name]
+    return targets, len(targets) > 0 || srv.parents[name]
+}
+
+func (s *Service) FindEC2Instances(scope Scope, filterFunc func(*EC2Instance) bool) (instances []EC2Instance) {
+    inv := s.inventory()
+    for _, inst := range filterScope(inv.candidates(scope), scope, filterFunc) {
+        instances = append(instances, *inst)
+    }
+    return instances
+}
+
+// SelectEC2Instances returns the cached instances matching a selector.
+func (s *Service) SelectEC2Instances(selector Selector, scope Scope) (instances []EC2Instance) {
+    if scope.States != nil {
+        return s.FindEC2Instances(scope, selector.Match)
+    }
+    for _, inst := range s.findEC2Instances(func(inst *EC2Instance) bool {
+        return scope.Match(inst) && selector.Match(inst)
+    }, 0) {
+        instances = append(instances, *inst)
+    }
+    return instances
+}
+
+func (s *Service) GetAllRDS(scope Scope) (databases []RDSDatabase) {
+    for _, db := range s.inventory().resources.Databases {
+        if scope.matchResource(db.Source, db.Account, db.Region) {
+            databases = append(databases, *db)
+        }
+    }
+    return databases
+}
+
+func (s *Service) GetRDSFromName(name string, scope Scope) (databases []RDSDatabase) {
+    for _, db := range s.inventory().databases[name] {
+        if scope.matchResource(db.Source, db.Account, db.Region) {
+            databases = append(databases, *db)
+        }
+    }
+    return databases
+}
+
+func (s *Service) GetAllLoadBalancers(scope Scope) (lbs []LoadBalancer) {
+    for _, lb := range s.inventory().resources.LoadBalancers {
+        if scope.matchResource(lb.Source, lb.Account, lb.Region) {
+            lbs = append(lbs, *lb)
         }
-        return true
-    })
+    }
+    return lbs
+}
+
+// GetLoadBalancerFromName matches load balancer names case-insensitively,
+// as they are used as DNS labels.
+func (s *Service) GetLoadBalancerFromName(name string, scope Scope) (lbs []LoadBalancer) {
+    for _, lb := range s.inventory().lbs[strings.ToLower(name)] {
+        if scope.matchResource(lb.Source, lb.Account, lb.Region) {
+            lbs = append(lbs, *lb)
+        }
+    }
+    return lbs
+}
+
+func (s *Service) GetAutoScalingGroups(name string, scope Scope) (groups []AutoScalingGroup) {
+    for _, group := range s.inventory().asgs[strings.ToLower(name)] {
+        if scope.matchResource(group.Source, group.Account, group.Region) {
+            groups = append(groups, *group)
+        }
+    }
+    return groups
+}
+
+// GetASGInstances resolves an auto scaling group name to its member
+// instances, only the in-service and healthy ones when healthyOnly is set.
+func (s *Service) GetASGInstances(name string, scope Scope, healthyOnly bool) (instances []EC2Instance) {
+    inv := s.inventory()
+    for _, group := range inv.asgs[strings.ToLower(name)] {
+        if !scope.matchResource(group.Source, group.Account, group.Region) {
+            continue
+        }
+        for _, member := range group.Instances {
+            if healthyOnly && !member.Healthy() {
+                continue
+            }
+            if inst, ok := inv.byID[member.ID]; ok {
+                instances = append(instances, *inst)
+            }
+        }
+    }
     return instances
 }
 
+func (s *Service) GetECSClusters(scope Scope) (clusters []ECSCluster) {
+    for _, cluster := range s.inventory().resources.ECSClusters {
+        if scope.matchResource(cluster.Source, cluster.Account, cluster.Region) {
+            clusters = append(clusters, *cluster)
+        }
+    }
+    return clusters
+}
+
+// GetECSTasks lists running tasks, all of them when cluster is empty and
+// every task of the cluster when service is empty.
+func (s *Service) GetECSTasks(cluster string, service string, scope Scope) (tasks []ECSTask) {
+    inv := s.inventory()
+    candidates := inv.resources.ECSTasks
+    if cluster != "" && service != "" {
+        candidates = inv.ecsTasks[ecsServiceKey(cluster, service)]
+    }
+    for _, task := range candidates {
+        if cluster != "" && !strings.EqualFold(cluster, task.Cluster) {
+            continue
+        }
+        if service != "" && !strings.EqualFold(service, task.Service) {
+            continue
+        }
+        if scope.matchResource(task.Source, task.Account, task.Region) {
+            tasks = append(tasks, *task)
+        }
+    }
+    return tasks
+}
+
+func (s *Service) GetVPCs(scope Scope) (vpcs []VPC) {
+    for _, vpc := range s.inventory().resources.VPCs {
+        if scope.matchResource(vpc.Source, vpc.Account, vpc.Region) {
+            vpcs = append(vpcs, *vpc)
+        }
+    }
+    return vpcs
+}
+
+func (s *Service) GetEC2FromID(id string) (error, EC2Instance) {
+    inst, ok := s.inventory().byID[id]
+    if !ok {
+        return notFoundError, EC2Instance{}
+    }
+    return nil, *inst
+}
+
+func (s *Service) GetEC2FromDNS(dnsName string) (error, EC2Instance) {
+    inst, ok := s.inventory().byDNS[normalizeDNSName(dnsName)]
+    if !ok {
+        return notFoundError, EC2Instance{}
+    }
+    return nil, *inst
+}
+
 func (s *Service) GetEC2NameFromIP(ip string) (error, string) {
-    instance := s.findEC2Instance(func(ec2 *EC2Instance) bool {
-        return ip != "" && (ec2.PrivateIP == ip || ec2.PublicIP == ip)
-    })
-    if instance == nil {
+    return s.GetEC2NameFromIPInScope(ip, Scope{})
+}
+
+func (s *Service) GetEC2NameFromIPInScope(ip string, scope Scope) (error, string) {
+    instance := s.inventory().findByIP(ip, scope)
+    if ip == "" || instance == nil {
         return notFoundError, ""
     } else {
         return nil, instance.Name
     }
 }
 
+// GetEC2HostnameFromIP returns a hostname resolving to the instance owning
+// ip alone, for PTR records, or "" when the instance has no such name.
+func (s *Service) GetEC2HostnameFromIP(ip string) (error, string) {
+    inv := s.inventory()
+    instance := inv.findByIP(ip, Scope{})
+    if ip == "" || instance == nil {
+        return notFoundError, ""
+    }
+    return nil, inv.ownName(instance)
+}
+
+// GetAddressOwner tells what owns an IP: a cached instance first, then any
+// ENI or Elastic IP found by address discovery.
+func (s *Service) GetAddressOwner(ip string, scope Scope) (error, AddressOwner) {
+    if ip == "" {
+        return notFoundError, AddressOwner{}
+    }
+    inv := s.inventory()
+    if inst := inv.findByIP(ip, scope); inst != nil {
+        return nil, AddressOwner{
+            IP: ip,
+            ResourceType: ResourceInstance,
+            ResourceID: inst.ID,
+            Name: inst.Name,
+        }
+    }
+    for _, addr := range inv.addresses[ip] {
+        if !scope.matchResource(addr.Source, addr.Account, addr.Region) {
+            continue
+        }
+        owner := AddressOwner{
+            IP: ip,
+            ResourceType: addr.ResourceType,
+            ResourceID: addr.ResourceID,
+            Name: addr.Name,
+        }
+        if addr.ResourceType == ResourceInstance {
+            if inst, ok := inv.byID[addr.ResourceID]; ok {
+                owner.Name = inst.Name
+            }
+        }
+        return nil, owner
+    }
+    return notFoundError, AddressOwner{}
+}
+
 func (s *Service) UpdateCache() error {
-    ec2 := ec2.New(session.New(s.awsConfig))
-    resp, err := ec2.DescribeInstances(nil)
+    ctx := context.Background()
+    started := time.Now()
+    err, instances := s.Source.ListInstances(ctx)
     if err != nil {
+        s.refreshState.record(err)
         return err;
     }
-    instances := make([]*EC2Instance, 0, 10)
-    for _, rev := range resp.Reservations {
-        for _, inst := range rev.Instances {
-            ec2 := newEC2(inst)
-            instances = append(instances, ec2)
+    // Keep the previous resources when only their listing fails. That is
+    // not a failed refresh, instances stay fresh and are not backed off.
+    resources := s.inventory().resources
+    if resourceSource, ok := s.Source.(ResourceSource); ok {
+        if err, listed := resourceSource.ListResources(ctx); err != nil {
+            s.logger.Printf("list resources failed, keeping previous result: %s", err.Error())
+        } else {
+            resources = listed
         }
     }
-    s.ec2Instances = instances
-    s.logger.Printf("got %d ec2 instances", len(instances))
+    s.refreshState.record(nil)
+    instances = s.namingPolicy.apply(instances)
+    // Events applied while the listing ran are newer than what it saw.
+    s.updateMu.Lock()
+    inv := newInventory(s.replayUpdates(instances, started), resources, s.statePolicy, s.namingPolicy)
+    s.cache.Store(inv)
+    s.updateMu.Unlock()
+    s.logger.Printf("got %d ec2 instances, %d in answered states", len(inv.all), len(inv.instances))
+    s.cacheUpdated()
     return nil
 }
 
-func newEC2(inst *ec2.Instance) *EC2Instance {
-    ec2 := &EC2Instance{}
-    for _, tag := range inst.Tags {
-        if tag.Key != nil && *tag.Key == "Name" {
-            ec2.Name = *tag.Value
-            break
-        }
+// cacheUpdated tells whoever mirrors the cache elsewhere that it changed.
+func (s *Service) cacheUpdated() {
+    if s.zoneSync != nil {
+        s.zoneSync.Notify()
     }
-    if inst.PublicDnsName != nil {
-        ec2.PubicDNS = *inst.PublicDnsName
-        ec2.Address = ec2.PubicDNS
-    }
-    if inst.PublicIpAddress != nil {
-        ec2.PublicIP = *inst.PublicIpAddress
+    s.listenersMu.Lock()
+    defer s.listenersMu.Unlock()
+    for _, ch := range s.listeners {
+        select {
+        case ch <- struct{}{}:
+        default:
+        }
     }
-    if inst.PrivateDnsName != nil {
-        ec2.PrivateDNS = *inst.PrivateDnsName
-        if ec2.Address == "" {
-            ec2.Address = ec2.PrivateDNS
+}
+
+// Subscribe returns a channel that receives a value whenever a refresh or
+// an event changes the cache. Changes made while the reader is busy are
+// coalesced into one notification.
+func (s *Service) Subscribe() <-chan struct{} {
+    ch := make(chan struct{}, 1)
+    s.listenersMu.Lock()
+    s.listeners = append(s.listeners, ch)
+    s.listenersMu.Unlock()
+    return ch
+}
+
+func (s *Service) Unsubscribe(ch <-chan struct{}) {
+    s.listenersMu.Lock()
+    defer s.listenersMu.Unlock()
+    for i, listener := range s.listeners {
+        if listener == ch {
+            s.listeners = append(s.listeners[:i], s.listeners[i + 1:]...)
+            return
         }
     }
-    if inst.PrivateIpAddress != nil {
-        ec2.PrivateIP = *inst.PrivateIpAddress
+}
+
+// PlanZoneSync returns the changes the Route 53 sync would make now.
+func (s *Service) PlanZoneSync(ctx context.Context) (error, []ZoneChange) {
+    if s.zoneSync == nil {
+        return errors.New("route53 sync is not configured"), nil
     }
-    ec2.UpdateTime = time.Now()
-    return ec2
+    return s.zoneSync.Plan(ctx)
+}
+
+func (s *Service) inventory() *inventory {
+    if inv, ok := s.cache.Load().(*inventory); ok {
+        return inv
+    }
+    return emptyInventory
 }
 
 func (s *Service) findEC2Instances(filterFunc func(*EC2Instance) bool, limit int) []*EC2Instance {
-    instances := s.ec2Instances
+    instances := s.inventory().instances
     filtered := make([]*EC2Instance, 0, limit)
     for _, inst := range instances {
         if filterFunc(inst) {
@@ -162,7 +553,7 @@ func (s *Service) findEC2Instance(filterFunc func(*EC2Instance) bool) *EC2Instan
 
 func (s *Service) eachEC2Instance(iterFunc func(index int, instance *EC2Instance) bool) int {
     loopCount := 0
-    for idx, inst := range s.ec2Instances {
+    for idx, inst := range s.inventory().instances {
         loopCount += 1
         if !iterFunc(idx, inst) {
             break
@@ -171,6 +562,27 @@ func (s *Service) eachEC2Instance(iterFunc func(index int, instance *EC2Instance
     return loopCount
 }
 
+// Addresses returns every private, public and IPv6 address of the instance.
+func (ec2 *EC2Instance) Addresses() []string {
+    addresses := make([]string, 0, len(ec2.PrivateIPs) + len(ec2.IPv6Addresses) + 2)
+    seen := make(map[string]bool)
+    add := func(ip string) {
+        if ip != "" && !seen[ip] {
+            seen[ip] = true
+            addresses = append(addresses, ip)
+        }
+    }
+    add(ec2.PrivateIP)
+    for _, ip := range ec2.PrivateIPs {
+        add(ip)
+    }
+    add(ec2.PublicIP)
+    for _, ip := range ec2.IPv6Addresses {
+        add(ip)
+    }
+    return addresses
+}
+
 func (ec2 *EC2Instance) Age() uint32 {
     return uint32(time.Now().Sub(ec2.UpdateTime).Seconds())
 }
\ No newline at end of file
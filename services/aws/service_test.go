@@ -0,0 +1,166 @@
+package aws
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+)
+
+const testInventory = `{
+    "instances": [
+        {
+            "ID": "i-0000000000000001",
+            "Name": "web",
+            "State": "running",
+            "Tags": {"Name": "web", "Role": "web"},
+            "PrivateIP": "10.0.1.10",
+            "PrivateIPs": ["10.0.1.10", "10.0.1.11"],
+            "PublicIP": "54.0.0.10",
+            "PublicDNS": "ec2-54-0-0-10.compute-1.amazonaws.com",
+            "IPv6Addresses": ["2600:1f18::10"]
+        },
+        {
+            "ID": "i-0000000000000002",
+            "Name": "db",
+            "State": "running",
+            "Tags": {"Name": "db", "Role": "db"},
+            "PrivateIP": "10.0.2.20"
+        },
+        {
+            "ID": "i-0000000000000003",
+            "Name": "old",
+            "State": "terminated",
+            "Tags": {"Name": "old"},
+            "PrivateIP": "10.0.3.30"
+        }
+    ]
+}`
+
+// writeInventory writes a static inventory file into a temporary directory.
+func writeInventory(t *testing.T, content string) string {
+    file := filepath.Join(t.TempDir(), "inventory.json")
+    if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return file
+}
+
+// newTestService opens a service reading a static inventory, with the
+// refresh loop slow enough not to interfere with the test.
+func newTestService(t *testing.T, c Config, content string) (*Service, string) {
+    file := writeInventory(t, content)
+    c.Inventory = InventoryStatic
+    c.InventoryFile = file
+    if c.RefreshInterval == "" {
+        c.RefreshInterval = "1h"
+    }
+    s := NewService(c)
+    if err := s.Open(); err != nil {
+        t.Fatalf("open: %s", err.Error())
+    }
+    t.Cleanup(func() { s.Close() })
+    return s, file
+}
+
+func TestUpdateCacheFromStaticSource(t *testing.T) {
+    s, file := newTestService(t, Config{}, testInventory)
+
+    health := s.Health()
+    if health.Stale || health.Instances != 2 || health.ConsecutiveFailures != 0 || health.LastSuccess.IsZero() {
+        t.Fatalf("unexpected health after open: %+v", health)
+    }
+    for _, inst := range s.FindEC2Instances(Scope{}, nil) {
+        if inst.Source != DefaultSource || inst.UpdateTime.IsZero() {
+            t.Errorf("%s: source %q, update time %s", inst.ID, inst.Source, inst.UpdateTime)
+        }
+    }
+
+    if err := ioutil.WriteFile(file, []byte(`{"instances": [{"ID": "i-4", "Name": "api", "State": "running", "PrivateIP": "10.0.4.40"}]}`), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.UpdateCache(); err != nil {
+        t.Fatalf("refresh: %s", err.Error())
+    }
+    if names := s.GetAllEC2Names(); len(names) != 1 || names[0] != "api" {
+        t.Errorf("names after refresh: %v", names)
+    }
+    if instances := s.GetEC2FromName("web"); len(instances) != 0 {
+        t.Errorf("web still cached after refresh: %v", instances)
+    }
+}
+
+func TestUpdateCacheKeepsInventoryOnFailure(t *testing.T) {
+    s, file := newTestService(t, Config{}, testInventory)
+
+    if err := ioutil.WriteFile(file, []byte("not json"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.UpdateCache(); err == nil {
+        t.Fatal("refresh of a broken file succeeded")
+    }
+    health := s.Health()
+    if health.ConsecutiveFailures != 1 || health.LastError == "" {
+        t.Errorf("unexpected health after failure: %+v", health)
+    }
+    if instances := s.GetEC2FromName("web"); len(instances) != 1 {
+        t.Errorf("web lost after failed refresh: %v", instances)
+    }
+}
+
+func TestGetEC2FromName(t *testing.T) {
+    s, _ := newTestService(t, Config{}, testInventory)
+
+    instances := s.GetEC2FromName("web")
+    if len(instances) != 1 || instances[0].ID != "i-0000000000000001" || instances[0].PrivateIP != "10.0.1.10" {
+        t.Fatalf("web: %+v", instances)
+    }
+    if instances := s.GetEC2FromName("missing"); len(instances) != 0 {
+        t.Errorf("missing: %+v", instances)
+    }
+    // Instances outside the state policy are only found when asked for.
+    if instances := s.GetEC2FromName("old"); len(instances) != 0 {
+        t.Errorf("terminated instance answered: %+v", instances)
+    }
+    if instances := s.GetEC2FromNameInScope("old", Scope{States: StatePolicy{}}); len(instances) != 1 {
+        t.Errorf("terminated instance not found with all states: %+v", instances)
+    }
+}
+
+func TestGetEC2NameFromIP(t *testing.T) {
+    s, _ := newTestService(t, Config{}, testInventory)
+
+    for _, test := range []struct {
+        ip   string
+        name string
+    }{
+        {"10.0.1.10", "web"},
+        {"10.0.1.11", "web"},
+        {"54.0.0.10", "web"},
+        {"2600:1f18::10", "web"},
+        {"10.0.2.20", "db"},
+    } {
+        err, name := s.GetEC2NameFromIP(test.ip)
+        if err != nil || name != test.name {
+            t.Errorf("%s: got %q, %v, want %q", test.ip, name, err, test.name)
+        }
+    }
+    for _, ip := range []string{"", "10.0.3.30", "192.0.2.1"} {
+        if err, name := s.GetEC2NameFromIP(ip); err == nil {
+            t.Errorf("%s: got %q, want an error", ip, name)
+        }
+    }
+}
+
+func TestGetEC2FromIDAndDNS(t *testing.T) {
+    s, _ := newTestService(t, Config{}, testInventory)
+
+    if err, inst := s.GetEC2FromID("i-0000000000000002"); err != nil || inst.Name != "db" {
+        t.Errorf("by id: %+v, %v", inst, err)
+    }
+    if err, inst := s.GetEC2FromDNS("EC2-54-0-0-10.compute-1.amazonaws.com."); err != nil || inst.Name != "web" {
+        t.Errorf("by dns: %+v, %v", inst, err)
+    }
+    if err, _ := s.GetEC2FromID("i-missing"); err == nil {
+        t.Error("unknown id found")
+    }
+}
@@ -0,0 +1,96 @@
+package aws
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+const (
+    snapshotVersion         = 1
+    defaultSnapshotInterval = 5 * time.Minute
+)
+
+// snapshot is the on-disk form of the inventory, loaded at startup so the
+// server can answer before the first refresh completes.
+type snapshot struct {
+    Version   int
+    Saved     time.Time
+    Instances []*EC2Instance
+    Resources *Resources
+}
+
+func (s *Service) loadSnapshot() error {
+    content, err := ioutil.ReadFile(s.Config.SnapshotFile)
+    if err != nil {
+        return err
+    }
+    snap := &snapshot{}
+    if err := json.Unmarshal(content, snap); err != nil {
+        return err
+    }
+    if snap.Version != snapshotVersion {
+        return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+    }
+    instances := s.namingPolicy.apply(snap.Instances)
+    s.updateMu.Lock()
+    s.cache.Store(newInventory(instances, snap.Resources, s.statePolicy, s.namingPolicy))
+    s.updateMu.Unlock()
+    s.logger.Printf("loaded %d ec2 instances from snapshot saved at %s", len(snap.Instances), snap.Saved)
+    return nil
+}
+
+// saveSnapshot writes to a temporary file and renames it over the old
+// snapshot so a crash never leaves a truncated file behind.
+func (s *Service) saveSnapshot() error {
+    snap := &snapshot{
+        Version: snapshotVersion,
+        Saved: time.Now(),
+        Instances: s.inventory().all,
+        Resources: s.inventory().resources,
+    }
+    content, err := json.Marshal(snap)
+    if err != nil {
+        return err
+    }
+    file := s.Config.SnapshotFile
+    tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file) + ".tmp")
+    if err != nil {
+        return err
+    }
+    if _, err := tmp.Write(content); err != nil {
+        tmp.Close()
+        os.Remove(tmp.Name())
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+    return os.Rename(tmp.Name(), file)
+}
+
+func (s *Service) snapshotLoop(stop chan struct{}, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    var saved *inventory
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+        }
+        inv := s.inventory()
+        if inv == saved || inv == emptyInventory {
+            continue
+        }
+        if err := s.saveSnapshot(); err != nil {
+            s.logger.Printf("save snapshot failed: %s", err.Error())
+            continue
+        }
+        saved = inv
+    }
+}
@@ -0,0 +1,62 @@
+package aws
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+    snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+    inventoryFile := writeInventory(t, testInventory)
+    c := Config{Inventory: InventoryStatic, InventoryFile: inventoryFile, RefreshInterval: "1h", SnapshotFile: snapshotFile}
+
+    s := NewService(c)
+    if err := s.Open(); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    // The inventory can no longer be read, so only the snapshot can answer.
+    if err := ioutil.WriteFile(inventoryFile, []byte("not json"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    s = NewService(c)
+    if err := s.Open(); err != nil {
+        t.Fatalf("warm start: %s", err.Error())
+    }
+    defer s.Close()
+
+    if instances := s.GetEC2FromName("web"); len(instances) != 1 || instances[0].PrivateIP != "10.0.1.10" || instances[0].Tags["Role"] != "web" {
+        t.Errorf("web from snapshot: %+v", instances)
+    }
+    if err, inst := s.GetEC2FromID("i-0000000000000002"); err != nil || inst.Name != "db" {
+        t.Errorf("db from snapshot: %+v, %v", inst, err)
+    }
+    health := s.Health()
+    if !health.Stale || health.Instances != 2 || !health.LastSuccess.IsZero() {
+        t.Errorf("warm start not reported stale: %+v", health)
+    }
+}
+
+func TestOpenRejectsBadSnapshotInterval(t *testing.T) {
+    for _, interval := range []string{"soon", "0s"} {
+        s := NewService(Config{
+            Inventory: InventoryStatic,
+            InventoryFile: writeInventory(t, testInventory),
+            SnapshotFile: filepath.Join(t.TempDir(), "snapshot.json"),
+            SnapshotInterval: interval,
+        })
+        err := s.Open()
+        if err == nil || !strings.Contains(err.Error(), "SnapshotInterval") {
+            t.Errorf("%s: open returned %v", interval, err)
+        }
+        if s.stop != nil {
+            t.Errorf("%s: refresh started before the interval was checked", interval)
+            s.Close()
+        }
+    }
+}
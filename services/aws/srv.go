@@ -0,0 +1,107 @@
+package aws
+
+import (
+    "sort"
+    "strconv"
+    "strings"
+)
+
+const defaultSRVTag = "dns:srv"
+
+// SRVTarget is an instance listing a service in its SRV tag, by a name
+// that resolves to that instance alone.
+type SRVTarget struct {
+    Name string
+    Port uint16
+}
+
+// srvIndex maps the names listed in SRV tags, such as "_http._tcp", to
+// their targets. parents holds the names above them, such as "_tcp", which
+// exist without records of their own.
+type srvIndex struct {
+    byName  map[string][]SRVTarget
+    parents map[string]bool
+}
+
+type srvEndpoint struct {
+    name string
+    port uint16
+}
+
+// parseSRVTag reads a comma separated list of <name>:<port> entries such as
+// "_http._tcp:8080,_metrics._tcp.web:9100", where name starts with the
+// _<service>._<proto> labels. Malformed entries are ignored.
+func parseSRVTag(value string) []srvEndpoint {
+    var endpoints []srvEndpoint
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        idx := strings.LastIndex(entry, ":")
+        if idx <= 0 {
+            continue
+        }
+        port, err := strconv.ParseUint(entry[idx + 1:], 10, 16)
+        if err != nil || port == 0 {
+            continue
+        }
+        name := strings.ToLower(strings.Trim(entry[:idx], "."))
+        labels := strings.Split(name, ".")
+        if len(labels) < 2 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+            continue
+        }
+        endpoints = append(endpoints, srvEndpoint{name: name, port: uint16(port)})
+    }
+    return endpoints
+}
+
+// indexSRV parses the SRV tag of every instance once, when the inventory
+// is built. Instances without a name of their own are left out.
+func (inv *inventory) indexSRV() {
+    inv.srv = srvIndex{
+        byName: make(map[string][]SRVTarget),
+        parents: make(map[string]bool),
+    }
+    for _, inst := range inv.instances {
+        value, ok := inst.Tags[inv.naming.srvTag]
+        if !ok {
+            continue
+        }
+        target := inv.ownName(inst)
+        if target == "" {
+            continue
+        }
+        for _, endpoint := range parseSRVTag(value) {
+            inv.srv.byName[endpoint.name] = append(inv.srv.byName[endpoint.name], SRVTarget{Name: target, Port: endpoint.port})
+            name := endpoint.name
+            for idx := strings.Index(name, "."); idx >= 0; idx = strings.Index(name, ".") {
+                name = name[idx + 1:]
+                inv.srv.parents[name] = true
+            }
+        }
+    }
+    for _, targets := range inv.srv.byName {
+        sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+    }
+}
+
+// ownName returns a hostname resolving to inst alone: its name when no
+// other instance shares it, or else the unique name the naming policy gives
+// it. Names that are not valid hostnames, such as "Web Server", give none.
+func (inv *inventory) ownName(inst *EC2Instance) string {
+    names := inst.names()
+    if len(names) == 0 || names[0] == "" {
+        return ""
+    }
+    name := strings.ToLower(names[0])
+    if sanitizeHostname(name) != name {
+        return ""
+    }
+    if len(inv.byName[name]) == 1 {
+        return name
+    }
+    for i, member := range inv.conflicts[name] {
+        if member == inst {
+            return inv.uniqueName(name, i + 1, inst)
+        }
+    }
+    return ""
+}
@@ -0,0 +1,65 @@
+package aws
+
+import (
+    "fmt"
+    "strings"
+)
+
+const (
+    StatesAll     = "all"
+    defaultStates = "running"
+)
+
+// instanceStates are the EC2 instance state names.
+var instanceStates = map[string]bool{
+    "pending": true,
+    "running": true,
+    "shutting-down": true,
+    "terminated": true,
+    "stopping": true,
+    "stopped": true,
+}
+
+// StatePolicy is the set of instance states kept in answers. An empty
+// policy keeps every instance.
+type StatePolicy map[string]bool
+
+// ParseStatePolicy reads a comma separated state list such as
+// "running,pending". "all" disables filtering. Anything that is not an EC2
+// state name is an error, a typo would otherwise hide every instance.
+func ParseStatePolicy(value string) (error, StatePolicy) {
+    policy := make(StatePolicy)
+    for _, state := range strings.Split(value, ",") {
+        state = strings.ToLower(strings.TrimSpace(state))
+        if state == StatesAll {
+            return nil, StatePolicy{}
+        }
+        if state == "" {
+            continue
+        }
+        if !instanceStates[state] {
+            return fmt.Errorf("unknown instance state %q", state), nil
+        }
+        policy[state] = true
+    }
+    return nil, policy
+}
+
+// Allow reports whether an instance in the given state is kept. Instances
+// without a known state, e.g. from a static inventory, are always kept.
+func (p StatePolicy) Allow(state string) bool {
+    return len(p) == 0 || state == "" || p[state]
+}
+
+func (p StatePolicy) filter(instances []*EC2Instance) []*EC2Instance {
+    if len(p) == 0 {
+        return instances
+    }
+    filtered := make([]*EC2Instance, 0, len(instances))
+    for _, inst := range instances {
+        if p.Allow(inst.State) {
+            filtered = append(filtered, inst)
+        }
+    }
+    return filtered
+}
@@ -0,0 +1,33 @@
+package aws
+
+import (
+    "testing"
+)
+
+func TestParseStatePolicy(t *testing.T) {
+    err, policy := ParseStatePolicy(" Running, pending ,")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(policy) != 2 || !policy.Allow("running") || !policy.Allow("pending") || policy.Allow("stopped") {
+        t.Errorf("unexpected policy %v", policy)
+    }
+    if err, policy := ParseStatePolicy("running,all"); err != nil || !policy.Allow("terminated") {
+        t.Errorf("all: %v, %v", policy, err)
+    }
+    if err, _ := ParseStatePolicy("runing"); err == nil {
+        t.Error("misspelt state accepted")
+    }
+}
+
+func TestOpenRejectsUnknownInstanceStates(t *testing.T) {
+    s := NewService(Config{
+        Inventory: InventoryStatic,
+        InventoryFile: writeInventory(t, testInventory),
+        InstanceStates: "running,stoped",
+    })
+    if err := s.Open(); err == nil {
+        s.Close()
+        t.Fatal("open succeeded with a misspelt state")
+    }
+}
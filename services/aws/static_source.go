@@ -0,0 +1,154 @@
+package aws
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "time"
+)
+
+// StaticSource serves the inventory from a JSON file, which is re-read on
+// every refresh so it can be edited while the server is running.
+type StaticSource struct {
+    Name string
+    File string
+}
+
+type staticInventory struct {
+    Instances         []*EC2Instance `json:"instances"`
+    Databases         []*RDSDatabase `json:"databases"`
+    LoadBalancers     []*LoadBalancer `json:"loadBalancers"`
+    AutoScalingGroups []*AutoScalingGroup `json:"autoScalingGroups"`
+    ECSClusters       []*ECSCluster `json:"ecsClusters"`
+    ECSTasks          []*ECSTask `json:"ecsTasks"`
+    Addresses         []*NetworkAddress `json:"addresses"`
+    VPCs              []*VPC `json:"vpcs"`
+}
+
+func NewStaticSource(name string, file string) *StaticSource {
+    return &StaticSource{
+        Name: name,
+        File: file,
+    }
+}
+
+func (s *StaticSource) String() string {
+    return fmt.Sprintf("%s/%s", s.Name, s.File)
+}
+
+func (s *StaticSource) ListInstances(ctx context.Context) (error, []*EC2Instance) {
+    err, inventory := s.load()
+    if err != nil {
+        return err, nil
+    }
+    now := time.Now()
+    for _, inst := range inventory.Instances {
+        if inst.UpdateTime.IsZero() {
+            inst.UpdateTime = now
+        }
+        if inst.Source == "" {
+            inst.Source = s.Name
+        }
+    }
+    return nil, inventory.Instances
+}
+
+func (s *StaticSource) ListResources(ctx context.Context) (error, *Resources) {
+    err, inventory := s.load()
+    if err != nil {
+        return err, nil
+    }
+    now := time.Now()
+    for _, db := range inventory.Databases {
+        if db.UpdateTime.IsZero() {
+            db.UpdateTime = now
+        }
+        if db.Source == "" {
+            db.Source = s.Name
+        }
+    }
+    for _, lb := range inventory.LoadBalancers {
+        if lb.UpdateTime.IsZero() {
+            lb.UpdateTime = now
+        }
+        if lb.Source == "" {
+            lb.Source = s.Name
+        }
+    }
+    for _, group := range inventory.AutoScalingGroups {
+        if group.UpdateTime.IsZero() {
+            group.UpdateTime = now
+        }
+        if group.Source == "" {
+            group.Source = s.Name
+        }
+    }
+    for _, cluster := range inventory.ECSClusters {
+        if cluster.UpdateTime.IsZero() {
+            cluster.UpdateTime = now
+        }
+        if cluster.Source == "" {
+            cluster.Source = s.Name
+        }
+    }
+    for _, task := range inventory.ECSTasks {
+        if task.UpdateTime.IsZero() {
+            task.UpdateTime = now
+        }
+        if task.Source == "" {
+            task.Source = s.Name
+        }
+    }
+    for _, addr := range inventory.Addresses {
+        if addr.UpdateTime.IsZero() {
+            addr.UpdateTime = now
+        }
+        if addr.Source == "" {
+            addr.Source = s.Name
+        }
+    }
+    for _, vpc := range inventory.VPCs {
+        if vpc.UpdateTime.IsZero() {
+            vpc.UpdateTime = now
+        }
+        if vpc.Source == "" {
+            vpc.Source = s.Name
+        }
+    }
+    return nil, &Resources{
+        Addresses: inventory.Addresses,
+        VPCs: inventory.VPCs,
+        Databases: inventory.Databases,
+        LoadBalancers: inventory.LoadBalancers,
+        AutoScalingGroups: inventory.AutoScalingGroups,
+        ECSClusters: inventory.ECSClusters,
+        ECSTasks: inventory.ECSTasks,
+    }
+}
+
+func (s *StaticSource) LookupInstance(ctx context.Context, account string, region string, id string) (error, *EC2Instance) {
+    err, instances := s.ListInstances(ctx)
+    if err != nil {
+        return err, nil
+    }
+    for _, inst := range instances {
+        if inst.ID == id {
+            return nil, inst
+        }
+    }
+    return notFoundError, nil
+}
+
+func (s *StaticSource) load() (error, *staticInventory) {
+    f, err := os.Open(s.File)
+    if err != nil {
+        return err, nil
+    }
+    defer f.Close()
+    inventory := &staticInventory{}
+    if err := json.NewDecoder(f).Decode(inventory); err != nil {
+        return err, nil
+    }
+    return nil, inventory
+}
@@ -0,0 +1,76 @@
+package aws
+
+import (
+    "context"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// VPC records the address ranges of a VPC, used to decide which reverse
+// DNS zones the server answers for.
+type VPC struct {
+    ID         string
+    Name       string
+    CIDRs      []string
+    IPv6CIDRs  []string
+    Tags       map[string]string
+    Source     string
+    Account    string
+    Region     string
+    UpdateTime time.Time
+}
+
+func (s *EC2Source) listVPCs(ctx context.Context) (error, []*VPC) {
+    var resp *ec2.DescribeVpcsOutput
+    err := s.retryThrottled(ctx, "describe vpcs", func() error {
+        var err error
+        resp, err = s.client.DescribeVpcsWithContext(ctx, &ec2.DescribeVpcsInput{})
+        return err
+    })
+    if err != nil {
+        return err, nil
+    }
+    account := s.Account(ctx)
+    vpcs := make([]*VPC, 0, len(resp.Vpcs))
+    for _, v := range resp.Vpcs {
+        vpc := newVPC(v)
+        vpc.Source = s.Name
+        vpc.Account = account
+        vpc.Region = s.Region
+        vpcs = append(vpcs, vpc)
+    }
+    s.logger.Printf("%s: fetched %d vpcs", s, len(vpcs))
+    return nil, vpcs
+}
+
+func newVPC(v *ec2.Vpc) *VPC {
+    vpc := &VPC{
+        ID: aws.StringValue(v.VpcId),
+        Tags: make(map[string]string, len(v.Tags)),
+        UpdateTime: time.Now(),
+    }
+    for _, tag := range v.Tags {
+        if tag.Key != nil {
+            vpc.Tags[*tag.Key] = aws.StringValue(tag.Value)
+        }
+    }
+    vpc.Name = vpc.Tags["Name"]
+    for _, assoc := range v.CidrBlockAssociationSet {
+        if assoc.CidrBlockState != nil && aws.StringValue(assoc.CidrBlockState.State) != ec2.VpcCidrBlockStateCodeAssociated {
+            continue
+        }
+        vpc.CIDRs = append(vpc.CIDRs, aws.StringValue(assoc.CidrBlock))
+    }
+    if len(vpc.CIDRs) == 0 && v.CidrBlock != nil {
+        vpc.CIDRs = append(vpc.CIDRs, *v.CidrBlock)
+    }
+    for _, assoc := range v.Ipv6CidrBlockAssociationSet {
+        if assoc.Ipv6CidrBlockState != nil && aws.StringValue(assoc.Ipv6CidrBlockState.State) != ec2.VpcCidrBlockStateCodeAssociated {
+            continue
+        }
+        vpc.IPv6CIDRs = append(vpc.IPv6CIDRs, aws.StringValue(assoc.Ipv6CidrBlock))
+    }
+    return vpc
+}
@@ -0,0 +1,10 @@
+package consul
+
+type Config struct {
+    Enabled    bool
+    Address    string
+    Datacenter string
+    Token      string
+    Service    string
+    Owner      string
+}
@@ -0,0 +1,318 @@
+package consul
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/page31/aws-meta-server/services/aws"
+)
+
+const (
+    defaultAddress = "http://127.0.0.1:8500"
+    defaultService = "ec2"
+    defaultOwner   = "aws-meta-server"
+    ownerMetaKey   = "external-source"
+    requestTimeout = 10 * time.Second
+    maxNodeMeta    = 64
+    maxMetaValue   = 512
+)
+
+// Service exports the cached instances to the Consul catalog, one node per
+// instance named after its ID, with the instance fields and tags as node
+// meta and the tags as "key=value" service tags. Nodes carry an ownership
+// meta key so vanished instances can be deregistered without touching
+// anything else. Address may point at a local Consul-compatible stand-in.
+type Service struct {
+    Config     *Config
+    AWSService *aws.Service
+    client     *http.Client
+    logger     *log.Logger
+    registered map[string]string
+    updates    <-chan struct{}
+    stop       chan struct{}
+    done       chan struct{}
+}
+
+type catalogRegistration struct {
+    Datacenter      string `json:",omitempty"`
+    Node            string
+    Address         string
+    TaggedAddresses map[string]string `json:",omitempty"`
+    NodeMeta        map[string]string
+    Service         *catalogService `json:",omitempty"`
+}
+
+type catalogService struct {
+    ID      string
+    Service string
+    Tags    []string
+}
+
+type catalogDeregistration struct {
+    Datacenter string `json:",omitempty"`
+    Node       string
+}
+
+type catalogNode struct {
+    Node    string
+    Address string
+    Meta    map[string]string
+}
+
+func NewService(c Config) *Service {
+    if c.Address == "" {
+        c.Address = defaultAddress
+    }
+    c.Address = strings.TrimSuffix(c.Address, "/")
+    if c.Service == "" {
+        c.Service = defaultService
+    }
+    if c.Owner == "" {
+        c.Owner = defaultOwner
+    }
+    s := &Service{
+        Config: &c,
+        client: &http.Client{Timeout: requestTimeout},
+        logger: log.New(os.Stderr, "[consul] ", log.LstdFlags),
+        registered: make(map[string]string),
+    }
+    return s
+}
+
+// Open exports the current cache and then follows every cache change. A
+// Consul outage is logged rather than failing the server, the next change
+// retries.
+func (s *Service) Open() error {
+    s.updates = s.AWSService.Subscribe()
+    s.stop = make(chan struct{})
+    s.done = make(chan struct{})
+    if err := s.Sync(); err != nil {
+        s.logger.Printf("export failed: %s", err.Error())
+    }
+    go s.run()
+    return nil
+}
+
+func (s *Service) Close() error {
+    if s.stop == nil {
+        return nil
+    }
+    close(s.stop)
+    <-s.done
+    s.stop = nil
+    s.AWSService.Unsubscribe(s.updates)
+    return nil
+}
+
+func (s *Service) run() {
+    defer close(s.done)
+    for {
+        select {
+        case <-s.stop:
+            return
+        case <-s.updates:
+        }
+        if err := s.Sync(); err != nil {
+            s.logger.Printf("export failed: %s", err.Error())
+        }
+    }
+}
+
+// Sync registers new and changed instances and deregisters the nodes this
+// exporter owns that are no longer cached. Unchanged nodes are only
+// registered again when they went missing from the catalog.
+func (s *Service) Sync() error {
+    err, present := s.listNodes()
+    if err != nil {
+        return err
+    }
+    desired := make(map[string]bool)
+    registered, deregistered := 0, 0
+    for _, inst := range s.AWSService.FindEC2Instances(aws.Scope{}, nil) {
+        reg := s.registration(inst)
+        if reg == nil {
+            continue
+        }
+        desired[reg.Node] = true
+        payload, err := json.Marshal(reg)
+        if err != nil {
+            return err
+        }
+        if _, ok := present[reg.Node]; ok && s.registered[reg.Node] == string(payload) {
+            continue
+        }
+        if err := s.put("/v1/catalog/register", payload); err != nil {
+            return fmt.Errorf("register %s: %s", reg.Node, err.Error())
+        }
+        s.registered[reg.Node] = string(payload)
+        registered++
+    }
+    for node := range present {
+        if desired[node] {
+            continue
+        }
+        payload, err := json.Marshal(catalogDeregistration{Datacenter: s.Config.Datacenter, Node: node})
+        if err != nil {
+            return err
+        }
+        if err := s.put("/v1/catalog/deregister", payload); err != nil {
+            return fmt.Errorf("deregister %s: %s", node, err.Error())
+        }
+        delete(s.registered, node)
+        deregistered++
+    }
+    if registered > 0 || deregistered > 0 {
+        s.logger.Printf("registered %d nodes, deregistered %d", registered, deregistered)
+    }
+    return nil
+}
+
+func (s *Service) registration(inst aws.EC2Instance) *catalogRegistration {
+    address := inst.PrivateIP
+    if address == "" {
+        address = inst.PublicIP
+    }
+    if inst.ID == "" || address == "" {
+        return nil
+    }
+    reg := &catalogRegistration{
+        Datacenter: s.Config.Datacenter,
+        Node: inst.ID,
+        Address: address,
+        NodeMeta: nodeMeta(inst),
+        Service: &catalogService{
+            ID: s.Config.Service,
+            Service: s.Config.Service,
+            Tags: serviceTags(inst),
+        },
+    }
+    reg.NodeMeta[ownerMetaKey] = s.Config.Owner
+    reg.TaggedAddresses = make(map[string]string)
+    if inst.PrivateIP != "" {
+        reg.TaggedAddresses["lan"] = inst.PrivateIP
+    }
+    if inst.PublicIP != "" {
+        reg.TaggedAddresses["wan"] = inst.PublicIP
+    }
+    return reg
+}
+
+// nodeMeta lists the instance fields first and fills the rest of Consul's
+// meta limit with tags, sorted by key. Keys only allow letters, digits, "-"
+// and "_", anything else becomes "_".
+func nodeMeta(inst aws.EC2Instance) map[string]string {
+    meta := make(map[string]string, maxNodeMeta)
+    add := func(key string, value string) {
+        if value == "" || len(meta) >= maxNodeMeta - 1 {
+            return
+        }
+        if len(value) > maxMetaValue {
+            value = value[:maxMetaValue]
+        }
+        meta[key] = value
+    }
+    add("ec2-name", inst.Name)
+    add("ec2-state", inst.State)
+    add("ec2-source", inst.Source)
+    add("ec2-account", inst.Account)
+    add("ec2-region", inst.Region)
+    add("ec2-az", inst.AvailabilityZone)
+    add("ec2-type", inst.InstanceType)
+    add("ec2-vpc", inst.VpcID)
+    add("ec2-subnet", inst.SubnetID)
+    for _, key := range sortedTagKeys(inst.Tags) {
+        add("tag-" + metaKey(key), inst.Tags[key])
+    }
+    return meta
+}
+
+func serviceTags(inst aws.EC2Instance) []string {
+    tags := make([]string, 0, len(inst.Tags))
+    for _, key := range sortedTagKeys(inst.Tags) {
+        tags = append(tags, key + "=" + inst.Tags[key])
+    }
+    return tags
+}
+
+func sortedTagKeys(tags map[string]string) []string {
+    keys := make([]string, 0, len(tags))
+    for key := range tags {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func metaKey(key string) string {
+    return strings.Map(func(r rune) rune {
+        if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+            return r
+        }
+        return '_'
+    }, key)
+}
+
+// listNodes returns the catalog nodes carrying this exporter's ownership
+// meta, by node name.
+func (s *Service) listNodes() (error, map[string]catalogNode) {
+    query := url.Values{}
+    query.Set("node-meta", ownerMetaKey + ":" + s.Config.Owner)
+    if s.Config.Datacenter != "" {
+        query.Set("dc", s.Config.Datacenter)
+    }
+    req, err := http.NewRequest("GET", s.Config.Address + "/v1/catalog/nodes?" + query.Encode(), nil)
+    if err != nil {
+        return err, nil
+    }
+    err, body := s.do(req)
+    if err != nil {
+        return err, nil
+    }
+    var nodes []catalogNode
+    if err := json.Unmarshal(body, &nodes); err != nil {
+        return err, nil
+    }
+    present := make(map[string]catalogNode, len(nodes))
+    for _, node := range nodes {
+        present[node.Node] = node
+    }
+    return nil, present
+}
+
+func (s *Service) put(path string, payload []byte) error {
+    req, err := http.NewRequest("PUT", s.Config.Address + path, bytes.NewReader(payload))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    err, _ = s.do(req)
+    return err
+}
+
+func (s *Service) do(req *http.Request) (error, []byte) {
+    if s.Config.Token != "" {
+        req.Header.Set("X-Consul-Token", s.Config.Token)
+    }
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return err, nil
+    }
+    defer resp.Body.Close()
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return err, nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body))), nil
+    }
+    return nil, body
+}
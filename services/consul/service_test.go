@@ -0,0 +1,177 @@
+package consul
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "testing"
+
+    "github.com/page31/aws-meta-server/services/aws"
+)
+
+// fakeCatalog is a local stand-in for the Consul catalog API, keeping
+// nodes in memory and counting the writes it gets.
+type fakeCatalog struct {
+    mu           sync.Mutex
+    token        string
+    nodes        map[string]catalogRegistration
+    registered   []string
+    deregistered []string
+}
+
+func (c *fakeCatalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if r.Header.Get("X-Consul-Token") != c.token {
+        w.WriteHeader(403)
+        w.Write([]byte("ACL not found"))
+        return
+    }
+    switch r.Method + " " + r.URL.Path {
+    case "GET /v1/catalog/nodes":
+        filter := strings.SplitN(r.URL.Query().Get("node-meta"), ":", 2)
+        nodes := []catalogNode{}
+        for _, reg := range c.nodes {
+            if len(filter) == 2 && reg.NodeMeta[filter[0]] != filter[1] {
+                continue
+            }
+            nodes = append(nodes, catalogNode{Node: reg.Node, Address: reg.Address, Meta: reg.NodeMeta})
+        }
+        json.NewEncoder(w).Encode(nodes)
+    case "PUT /v1/catalog/register":
+        var reg catalogRegistration
+        if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+            w.WriteHeader(400)
+            return
+        }
+        c.nodes[reg.Node] = reg
+        c.registered = append(c.registered, reg.Node)
+        w.Write([]byte("true"))
+    case "PUT /v1/catalog/deregister":
+        var dereg catalogDeregistration
+        if err := json.NewDecoder(r.Body).Decode(&dereg); err != nil {
+            w.WriteHeader(400)
+            return
+        }
+        delete(c.nodes, dereg.Node)
+        c.deregistered = append(c.deregistered, dereg.Node)
+        w.Write([]byte("true"))
+    default:
+        w.WriteHeader(404)
+    }
+}
+
+// writes returns and resets the nodes registered and deregistered so far.
+func (c *fakeCatalog) writes() (string, string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    sort.Strings(c.registered)
+    sort.Strings(c.deregistered)
+    registered, deregistered := strings.Join(c.registered, ","), strings.Join(c.deregistered, ",")
+    c.registered, c.deregistered = nil, nil
+    return registered, deregistered
+}
+
+func (c *fakeCatalog) remove(node string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    delete(c.nodes, node)
+}
+
+const (
+    webInstance = `{"ID": "i-1", "Name": "web", "State": "running", "Tags": {"Role": "web", "aws:cloudformation:stack-name": "app"}, "PrivateIP": "10.0.1.10", "PublicIP": "54.0.0.10"}`
+    dbInstance  = `{"ID": "i-2", "Name": "db", "State": "running", "PrivateIP": "10.0.2.20"}`
+)
+
+func TestSync(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "inventory.json")
+    writeInventory := func(instances ...string) {
+        content := `{"instances": [` + strings.Join(instances, ",") + `]}`
+        if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    writeInventory(webInstance, dbInstance)
+    awsService := aws.NewService(aws.Config{Inventory: aws.InventoryStatic, InventoryFile: file, RefreshInterval: "1h"})
+    if err := awsService.Open(); err != nil {
+        t.Fatal(err)
+    }
+    defer awsService.Close()
+
+    catalog := &fakeCatalog{
+        token: "secret",
+        nodes: map[string]catalogRegistration{
+            "consul-1": {Node: "consul-1", Address: "10.0.0.2", NodeMeta: map[string]string{}},
+            "i-gone": {Node: "i-gone", Address: "10.0.9.9", NodeMeta: map[string]string{ownerMetaKey: defaultOwner}},
+        },
+    }
+    server := httptest.NewServer(catalog)
+    defer server.Close()
+
+    s := NewService(Config{Address: server.URL + "/", Token: "secret"})
+    s.AWSService = awsService
+
+    if err := s.Sync(); err != nil {
+        t.Fatalf("first sync: %s", err.Error())
+    }
+    if registered, deregistered := catalog.writes(); registered != "i-1,i-2" || deregistered != "i-gone" {
+        t.Errorf("first sync registered %q, deregistered %q", registered, deregistered)
+    }
+    web := catalog.nodes["i-1"]
+    if web.Address != "10.0.1.10" || web.TaggedAddresses["wan"] != "54.0.0.10" || web.NodeMeta["ec2-name"] != "web" ||
+        web.NodeMeta["tag-aws_cloudformation_stack-name"] != "app" || web.NodeMeta[ownerMetaKey] != defaultOwner {
+        t.Errorf("web registration: %+v", web)
+    }
+    if web.Service == nil || web.Service.Service != defaultService || strings.Join(web.Service.Tags, ",") != "Role=web,aws:cloudformation:stack-name=app" {
+        t.Errorf("web service: %+v", web.Service)
+    }
+    if _, ok := catalog.nodes["consul-1"]; !ok {
+        t.Error("node not owned by the exporter was deregistered")
+    }
+
+    // Nothing changed, nothing is written.
+    if err := s.Sync(); err != nil {
+        t.Fatal(err)
+    }
+    if registered, deregistered := catalog.writes(); registered != "" || deregistered != "" {
+        t.Errorf("unchanged sync registered %q, deregistered %q", registered, deregistered)
+    }
+
+    // A node that went missing from the catalog is registered again.
+    catalog.remove("i-1")
+    if err := s.Sync(); err != nil {
+        t.Fatal(err)
+    }
+    if registered, deregistered := catalog.writes(); registered != "i-1" || deregistered != "" {
+        t.Errorf("after removal registered %q, deregistered %q", registered, deregistered)
+    }
+
+    // A vanished instance is deregistered.
+    writeInventory(webInstance)
+    if err := awsService.UpdateCache(); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Sync(); err != nil {
+        t.Fatal(err)
+    }
+    if registered, deregistered := catalog.writes(); registered != "" || deregistered != "i-2" {
+        t.Errorf("after db vanished registered %q, deregistered %q", registered, deregistered)
+    }
+}
+
+func TestSyncFailsWithoutToken(t *testing.T) {
+    catalog := &fakeCatalog{token: "secret", nodes: map[string]catalogRegistration{}}
+    server := httptest.NewServer(catalog)
+    defer server.Close()
+
+    s := NewService(Config{Address: server.URL})
+    s.AWSService = aws.NewService(aws.Config{})
+    if err := s.Sync(); err == nil || !strings.Contains(err.Error(), "403") {
+        t.Errorf("sync without a token: %v", err)
+    }
+}
@@ -4,4 +4,5 @@ type Config struct {
     Enabled     bool
     BindAddress string
     Url         string
+    EventSecret string
 }
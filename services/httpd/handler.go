@@ -1,5 +1,10 @@
 package httpd
 import (
+    "context"
+    "crypto/subtle"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
     "log"
     "os"
     "net/http"
@@ -9,6 +14,12 @@ import (
     "net"
     "strings"
     "reflect"
+    "strconv"
+)
+
+const (
+    eventSecretHeader = "X-Event-Secret"
+    maxEventSize      = 256 << 10
 )
 
 type route struct {
@@ -19,11 +30,12 @@ type route struct {
 }
 
 type Handler struct {
-    mux        *pat.PatternServeMux
-    routes     []route
-    logger     *log.Logger
-    Version    string
-    AWSService *aws.Service
+    mux         *pat.PatternServeMux
+    routes      []route
+    logger      *log.Logger
+    Version     string
+    EventSecret string
+    AWSService  *aws.Service
 }
 
 type HTTPHandler func(http.ResponseWriter, *http.Request)
@@ -38,7 +50,19 @@ func NewHandler() *Handler {
         route{"IP2EC2name", "GET", "/ec2/name", h.serveEC2NameFromIP},
         route{"Names", "GET", "/ec2/names", h.serveEC2Names},
         route{"Update", "GET", "/update", h.serveUpdate},
+        route{"Health", "GET", "/health", h.serveHealth},
+        route{"EC2Event", "POST", "/events/ec2", h.serveEC2Event},
         route{"Name2EC2IP", "GET", "/ec2/ip", h.serveEC2IPFromName},
+        route{"EC2Instance", "GET", "/ec2/instance", h.serveEC2Instance},
+        route{"EC2Instances", "GET", "/ec2/instances", h.serveEC2Instances},
+        route{"NameConflicts", "GET", "/ec2/conflicts", h.serveNameConflicts},
+        route{"RDSDatabases", "GET", "/rds/databases", h.serveRDSDatabases},
+        route{"RDSEndpoint", "GET", "/rds/endpoint", h.serveRDSEndpoint},
+        route{"LoadBalancers", "GET", "/elb/loadbalancers", h.serveLoadBalancers},
+        route{"ASGInstances", "GET", "/asg/instances", h.serveASGInstances},
+        route{"ECSClusters", "GET", "/ecs/clusters", h.serveECSClusters},
+        route{"ECSTasks", "GET", "/ecs/tasks", h.serveECSTasks},
+        route{"Route53Diff", "GET", "/route53/diff", h.serveRoute53Diff},
     })
     return h
 }
@@ -108,27 +132,85 @@ func (h *Handler) serveEC2NameFromIP(w http.ResponseWriter, r *http.Request) {
             ip = clientIp
         }
     }
-    err, name := h.AWSService.GetEC2NameFromIP(ip)
+    err, scope := scopeFromQuery(r)
+    if err != nil {
+        writeBadRequest(w, err)
+        return
+    }
+    err, owner := h.AWSService.GetAddressOwner(ip, scope)
     if err != nil {
         writeError(w, err)
-    } else {
-        writeString(w, name)
+        return
+    }
+    if detail, _ := strconv.ParseBool(r.URL.Query().Get("detail")); detail {
+        writeJSON(w, owner)
+        return
     }
+    // Instances answer with their Name tag as they always did, anything
+    // else falls back to its resource ID when it has no name.
+    name := owner.Name
+    if name == "" && owner.ResourceType != aws.ResourceInstance {
+        name = owner.ResourceID
+    }
+    writeString(w, name)
 }
 
 func (h *Handler) serveEC2Names(w http.ResponseWriter, r *http.Request) {
+    err, scope := scopeFromQuery(r)
+    if err != nil {
+        writeBadRequest(w, err)
+        return
+    }
     w.WriteHeader(200)
-    w.Write([]byte(strings.Join(h.AWSService.GetAllEC2Names(), "\n")))
+    w.Write([]byte(strings.Join(h.AWSService.GetEC2NamesInScope(scope), "\n")))
+}
+
+func scopeFromQuery(r *http.Request) (error, aws.Scope) {
+    query := r.URL.Query()
+    return newScope(query.Get("source"), query.Get("account"), query.Get("region"), query.Get("states"))
+}
+
+// newScope builds a lookup scope, states overrides the configured instance
+// state policy for diagnostic lookups.
+func newScope(source string, account string, region string, states string) (error, aws.Scope) {
+    scope := aws.Scope{
+        Source: source,
+        Account: account,
+        Region: region,
+    }
+    if states != "" {
+        err, policy := aws.ParseStatePolicy(states)
+        if err != nil {
+            return err, scope
+        }
+        scope.States = policy
+    }
+    return nil, scope
 }
 
 type ec2IPFromNameRequest struct {
     Name    string `bind:"name" required:"true"`
     Public  bool `bind:"public"`
     Private bool `bind:"private" default:"true"`
+    IPv6    bool `bind:"ipv6"`
+    Source  string `bind:"source"`
+    Account string `bind:"account"`
+    Region  string `bind:"region"`
+    States  string `bind:"states"`
 }
 
 func (h *Handler) serveEC2IPFromName(w http.ResponseWriter, request ec2IPFromNameRequest) {
-    instances := h.AWSService.GetEC2FromName(request.Name)
+    err, scope := newScope(request.Source, request.Account, request.Region, request.States)
+    if err != nil {
+        writeBadRequest(w, err)
+        return
+    }
+    err, instances := h.AWSService.ResolveEC2Name(request.Name, scope)
+    if err == aws.DuplicateNameError {
+        w.WriteHeader(409)
+        w.Write([]byte(err.Error() + "\n"))
+        return
+    }
     w.WriteHeader(200)
     if len(instances) > 0 {
         for _, inst := range instances {
@@ -139,6 +221,9 @@ func (h *Handler) serveEC2IPFromName(w http.ResponseWriter, request ec2IPFromNam
             if request.Public {
                 value += "|" + inst.PublicIP
             }
+            if request.IPv6 {
+                value += "|" + strings.Join(inst.IPv6Addresses, ",")
+            }
             if len(value) > 0 {
                 w.Write([]byte(value + "\n"));
             }
@@ -146,6 +231,293 @@ func (h *Handler) serveEC2IPFromName(w http.ResponseWriter, request ec2IPFromNam
     }
 }
 
+type ec2InstanceRequest struct {
+    ID           string `bind:"id"`
+    Name         string `bind:"name"`
+    Source       string `bind:"source"`
+    Account      string `bind:"account"`
+    Region       string `bind:"region"`
+    Zone         string `bind:"az"`
+    VpcID        string `bind:"vpc"`
+    SubnetID     string `bind:"subnet"`
+    InstanceType string `bind:"type"`
+    State        string `bind:"state"`
+    States       string `bind:"states"`
+}
+
+func (request ec2InstanceRequest) match(inst *aws.EC2Instance) bool {
+    return (request.ID == "" || request.ID == inst.ID) &&
+        (request.Name == "" || request.Name == inst.Name) &&
+        (request.Zone == "" || request.Zone == inst.AvailabilityZone) &&
+        (request.VpcID == "" || request.VpcID == inst.VpcID) &&
+        (request.SubnetID == "" || request.SubnetID == inst.SubnetID) &&
+        (request.InstanceType == "" || request.InstanceType == inst.InstanceType) &&
+        (request.State == "" || request.State == inst.State)
+}
+
+func (h *Handler) serveEC2Instance(w http.ResponseWriter, request ec2InstanceRequest) {
+    states := request.States
+    if states == "" {
+        states = request.State
+    }
+    err, scope := newScope(request.Source, request.Account, request.Region, states)
+    if err != nil {
+        writeBadRequest(w, err)
+        return
+    }
+    instances := h.AWSService.FindEC2Instances(scope, request.match)
+    if instances == nil {
+        instances = []aws.EC2Instance{}
+    }
+    writeJSON(w, instances)
+}
+
+type ec2InstancesRequest struct {
+    Selector string `bind:"selector"`
+    Source   string `bind:"source"`
+    Account  string `bind:"account"`
+    Region   string `bind:"region"`
+    States   string `bind:"states"`
+}
+
+// serveEC2Instances lists the instances matching a selector such as
+// "Role=web,Env in (prod,staging),@az=us-east-1a".
+func (h *Handler) serveEC2Instances(w http.ResponseWriter, request ec2InstancesRequest) {
+    err, selector := aws.ParseSelector(request.Selector)
+    if err != nil {
+        w.WriteHeader(400)
+        w.Write([]byte(err.Error() + "\n"))
+        return
+    }
+    err, scope := newScope(request.Source, request.Account, request.Region, request.States)
+    if err != nil {
+        writeBadRequest(w, err)
+        return
+    }
+    instances := h.AWSService.SelectEC2Instances(selector, scope)
+    if instances == nil {
+        instances = []aws.EC2Instance{}
+    }
+    writeJSON(w, instances)
+}
+
+// serveNameConflicts lists the names shared by several instances and how
+// the duplicate name policy resolves them.
+func (h *Handler) serveNameConflicts(w http.ResponseWriter, r *http.Request) {
+    err, scope := scopeFromQuery(r)
+    if err != nil {
+        writeBadRequest(w, err)
+        return
+    }
+    writeJSON(w, h.AWSService.GetNameConflicts(scope))
+}
+
+type rdsDatabasesRequest struct {
+    Name    string `bind:"name"`
+    Kind    string `bind:"kind"`
+    Engine  string `bind:"engine"`
+    Source  string `bind:"source"`
+    Account string `bind:"account"`
+    Region  string `bind:"region"`
+}
+
+func (h *Handler) serveRDSDatabases(w http.ResponseWriter, request rdsDatabasesRequest) {
+    _, scope := newScope(request.Source, request.Account, request.Region, "")
+    databases := make([]aws.RDSDatabase, 0)
+    for _, db := range h.AWSService.GetAllRDS(scope) {
+        if (request.Name == "" || request.Name == db.ID) &&
+            (request.Kind == "" || request.Kind == db.Kind) &&
+            (request.Engine == "" || request.Engine == db.Engine) {
+            databases = append(databases, db)
+        }
+    }
+    writeJSON(w, databases)
+}
+
+type rdsEndpointRequest struct {
+    Name    string `bind:"name" required:"true"`
+    Reader  bool `bind:"reader"`
+    Source  string `bind:"source"`
+    Account string `bind:"account"`
+    Region  string `bind:"region"`
+}
+
+func (h *Handler) serveRDSEndpoint(w http.ResponseWriter, request rdsEndpointRequest) {
+    _, scope := newScope(request.Source, request.Account, request.Region, "")
+    w.WriteHeader(200)
+    for _, db := range h.AWSService.GetRDSFromName(request.Name, scope) {
+        endpoint := db.Endpoint
+        if request.Reader {
+            endpoint = db.ReaderEndpoint
+        }
+        if endpoint != "" {
+            w.Write([]byte(fmt.Sprintf("%s:%d\n", endpoint, db.Port)))
+        }
+    }
+}
+
+type loadBalancersRequest struct {
+    Name    string `bind:"name"`
+    Type    string `bind:"type"`
+    Tag     string `bind:"tag"`
+    Source  string `bind:"source"`
+    Account string `bind:"account"`
+    Region  string `bind:"region"`
+}
+
+// serveLoadBalancers lists load balancers with their target health. tag
+// filters on "key" or "key=value".
+func (h *Handler) serveLoadBalancers(w http.ResponseWriter, request loadBalancersRequest) {
+    _, scope := newScope(request.Source, request.Account, request.Region, "")
+    var candidates []aws.LoadBalancer
+    if request.Name != "" {
+        candidates = h.AWSService.GetLoadBalancerFromName(request.Name, scope)
+    } else {
+        candidates = h.AWSService.GetAllLoadBalancers(scope)
+    }
+    tagKey, tagValue, hasValue := splitTagFilter(request.Tag)
+    lbs := make([]aws.LoadBalancer, 0, len(candidates))
+    for _, lb := range candidates {
+        if request.Type != "" && request.Type != lb.Type {
+            continue
+        }
+        if tagKey != "" {
+            value, ok := lb.Tags[tagKey]
+            if !ok || (hasValue && value != tagValue) {
+                continue
+            }
+        }
+        lbs = append(lbs, lb)
+    }
+    writeJSON(w, lbs)
+}
+
+type asgInstancesRequest struct {
+    Name    string `bind:"name" required:"true"`
+    Healthy bool `bind:"healthy" default:"true"`
+    Source  string `bind:"source"`
+    Account string `bind:"account"`
+    Region  string `bind:"region"`
+}
+
+func (h *Handler) serveASGInstances(w http.ResponseWriter, request asgInstancesRequest) {
+    _, scope := newScope(request.Source, request.Account, request.Region, "")
+    instances := h.AWSService.GetASGInstances(request.Name, scope, request.Healthy)
+    if instances == nil {
+        instances = []aws.EC2Instance{}
+    }
+    writeJSON(w, instances)
+}
+
+type ecsRequest struct {
+    Cluster string `bind:"cluster"`
+    Service string `bind:"service"`
+    Source  string `bind:"source"`
+    Account string `bind:"account"`
+    Region  string `bind:"region"`
+}
+
+func (h *Handler) serveECSClusters(w http.ResponseWriter, request ecsRequest) {
+    _, scope := newScope(request.Source, request.Account, request.Region, "")
+    clusters := make([]aws.ECSCluster, 0)
+    for _, cluster := range h.AWSService.GetECSClusters(scope) {
+        if request.Cluster == "" || strings.EqualFold(request.Cluster, cluster.Name) {
+            clusters = append(clusters, cluster)
+        }
+    }
+    writeJSON(w, clusters)
+}
+
+func (h *Handler) serveECSTasks(w http.ResponseWriter, request ecsRequest) {
+    _, scope := newScope(request.Source, request.Account, request.Region, "")
+    tasks := h.AWSService.GetECSTasks(request.Cluster, request.Service, scope)
+    if tasks == nil {
+        tasks = []aws.ECSTask{}
+    }
+    writeJSON(w, tasks)
+}
+
+// serveRoute53Diff shows the record changes the next Route 53 sync would
+// make, whether or not it runs in dry-run mode.
+func (h *Handler) serveRoute53Diff(w http.ResponseWriter, r *http.Request) {
+    err, changes := h.AWSService.PlanZoneSync(r.Context())
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if changes == nil {
+        changes = []aws.ZoneChange{}
+    }
+    writeJSON(w, changes)
+}
+
+func splitTagFilter(filter string) (string, string, bool) {
+    idx := strings.Index(filter, "=")
+    if idx < 0 {
+        return filter, "", false
+    }
+    return filter[:idx], filter[idx + 1:], true
+}
+
+func (h *Handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+    health := h.AWSService.Health()
+    content, err := json.Marshal(health)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    if health.Stale {
+        w.WriteHeader(503)
+    } else {
+        w.WriteHeader(200)
+    }
+    w.Write(content)
+}
+
+// serveEC2Event applies an EC2 state-change event POSTed by a webhook.
+// Requests carrying the EventSecret in X-Event-Secret are trusted, any
+// other event is only applied once the source confirms the state.
+func (h *Handler) serveEC2Event(w http.ResponseWriter, r *http.Request) {
+    trusted := false
+    if h.EventSecret != "" {
+        if subtle.ConstantTimeCompare([]byte(r.Header.Get(eventSecretHeader)), []byte(h.EventSecret)) != 1 {
+            w.WriteHeader(403)
+            w.Write([]byte("bad or missing " + eventSecretHeader + "\n"))
+            return
+        }
+        trusted = true
+    }
+    body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEventSize))
+    if err != nil {
+        writeBadRequest(w, err)
+        return
+    }
+    err, event := aws.ParseInstanceStateEvent(body)
+    if err != nil {
+        w.WriteHeader(400)
+        w.Write([]byte(err.Error() + "\n"))
+        return
+    }
+    if !trusted {
+        err := h.AWSService.ConfirmInstanceStateEvent(r.Context(), event)
+        if err == aws.EventNotConfirmedError {
+            w.WriteHeader(409)
+            w.Write([]byte(err.Error() + "\n"))
+            return
+        }
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+    }
+    if err := h.AWSService.ApplyInstanceStateEvent(context.Background(), event); err != nil {
+        writeError(w, err)
+        return
+    }
+    writeOK(w)
+}
+
 func (h *Handler) serveUpdate() error {
     return h.AWSService.UpdateCache()
 }
@@ -155,11 +527,27 @@ func writeError(w http.ResponseWriter, err error) {
     w.Write([]byte(err.Error() + "\n"))
 }
 
+func writeBadRequest(w http.ResponseWriter, err error) {
+    w.WriteHeader(400)
+    w.Write([]byte(err.Error() + "\n"))
+}
+
 func writeOK(w http.ResponseWriter) {
     w.WriteHeader(200)
     w.Write([]byte("OK\n"))
 }
 
+func writeJSON(w http.ResponseWriter, value interface{}) {
+    content, err := json.Marshal(value)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(200)
+    w.Write(content)
+}
+
 func writeString(w http.ResponseWriter, content string) {
     w.WriteHeader(200)
     w.Write([]byte(content))
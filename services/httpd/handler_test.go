@@ -0,0 +1,343 @@
+package httpd
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/page31/aws-meta-server/services/aws"
+)
+
+const testInventory = `{
+    "instances": [
+        {
+            "ID": "i-0000000000000001",
+            "Name": "web",
+            "State": "running",
+            "Tags": {"Name": "web", "Role": "web", "Env": "prod"},
+            "PrivateIP": "10.0.1.10",
+            "PublicIP": "54.0.0.10",
+            "IPv6Addresses": ["2600:1f18::10"]
+        },
+        {
+            "ID": "i-0000000000000002",
+            "Name": "db",
+            "State": "stopped",
+            "Tags": {"Name": "db", "Role": "db", "Env": "prod"},
+            "PrivateIP": "10.0.2.20"
+        }
+    ]
+}`
+
+// newTestHandler serves a static inventory through a handler.
+func newTestHandler(t *testing.T, c aws.Config, inventory string) *Handler {
+    file := filepath.Join(t.TempDir(), "inventory.json")
+    if err := ioutil.WriteFile(file, []byte(inventory), 0644); err != nil {
+        t.Fatal(err)
+    }
+    c.Inventory = aws.InventoryStatic
+    c.InventoryFile = file
+    c.RefreshInterval = "1h"
+    service := aws.NewService(c)
+    if err := service.Open(); err != nil {
+        t.Fatalf("open: %s", err.Error())
+    }
+    t.Cleanup(func() { service.Close() })
+    h := NewHandler()
+    h.AWSService = service
+    return h
+}
+
+// get requests a path and returns the status and body.
+func get(t *testing.T, h http.Handler, path string) (int, string) {
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+    return w.Code, w.Body.String()
+}
+
+func TestEC2IPFromNameHonoursStates(t *testing.T) {
+    h := newTestHandler(t, aws.Config{}, testInventory)
+
+    for _, test := range []struct {
+        path   string
+        status int
+        body   string
+    }{
+        {"/ec2/ip?name=web", 200, "10.0.1.10\n"},
+        {"/ec2/ip?name=web&public=true&ipv6=true", 200, "10.0.1.10|54.0.0.10|2600:1f18::10\n"},
+        {"/ec2/ip?name=db", 200, ""},
+        {"/ec2/ip?name=db&states=stopped", 200, "10.0.2.20\n"},
+        {"/ec2/ip?name=db&states=all", 200, "10.0.2.20\n"},
+        {"/ec2/ip?name=db&states=stoped", 400, ""},
+        {"/ec2/ip", 400, ""},
+    } {
+        status, body := get(t, h, test.path)
+        if status != test.status || (status == 200 && body != test.body) {
+            t.Errorf("%s: got %d %q, want %d %q", test.path, status, body, test.status, test.body)
+        }
+    }
+}
+
+func TestEC2InstanceStateFilter(t *testing.T) {
+    h := newTestHandler(t, aws.Config{InstanceStates: "running,stopped"}, testInventory)
+
+    status, body := get(t, h, "/ec2/instance?state=stopped")
+    if status != 200 || !strings.Contains(body, "i-0000000000000002") || strings.Contains(body, "i-0000000000000001") {
+        t.Errorf("state=stopped: %d %s", status, body)
+    }
+    if status, body := get(t, h, "/ec2/names"); status != 200 || body != "web\ndb" {
+        t.Errorf("names: %d %q", status, body)
+    }
+    if status, _ := get(t, h, "/ec2/names?states=bogus"); status != 400 {
+        t.Errorf("names with a bad state: %d", status)
+    }
+}
+
+// post sends a body to a path with optional headers.
+func post(t *testing.T, h http.Handler, path string, body string, headers map[string]string) (int, string) {
+    w := httptest.NewRecorder()
+    r := httptest.NewRequest("POST", path, strings.NewReader(body))
+    for key, value := range headers {
+        r.Header.Set(key, value)
+    }
+    h.ServeHTTP(w, r)
+    return w.Code, w.Body.String()
+}
+
+func stateEvent(id string, state string) string {
+    return `{"detail-type": "EC2 Instance State-change Notification", "source": "aws.ec2", "detail": {"instance-id": "` + id + `", "state": "` + state + `"}}`
+}
+
+func TestEC2EventIsConfirmed(t *testing.T) {
+    h := newTestHandler(t, aws.Config{}, testInventory)
+
+    // The static inventory still lists web as running.
+    if status, body := post(t, h, "/events/ec2", stateEvent("i-0000000000000001", "terminated"), nil); status != 409 {
+        t.Errorf("unconfirmed termination: %d %s", status, body)
+    }
+    if _, body := get(t, h, "/ec2/ip?name=web"); body != "10.0.1.10\n" {
+        t.Errorf("web dropped by an unconfirmed event: %q", body)
+    }
+    if status, body := post(t, h, "/events/ec2", stateEvent("i-0000000000000001", "running"), nil); status != 200 {
+        t.Errorf("confirmed event: %d %s", status, body)
+    }
+    if status, _ := post(t, h, "/events/ec2", "{}", nil); status != 400 {
+        t.Errorf("not an event: %d", status)
+    }
+    large := stateEvent("i-0000000000000001", "running" + strings.Repeat(" ", maxEventSize))
+    if status, _ := post(t, h, "/events/ec2", large, nil); status != 400 {
+        t.Errorf("oversized event: %d", status)
+    }
+}
+
+func TestEC2EventWithSecret(t *testing.T) {
+    h := newTestHandler(t, aws.Config{}, testInventory)
+    h.EventSecret = "s3cret"
+    event := stateEvent("i-0000000000000001", "terminated")
+
+    if status, _ := post(t, h, "/events/ec2", event, nil); status != 403 {
+        t.Errorf("missing secret: %d", status)
+    }
+    if status, _ := post(t, h, "/events/ec2", event, map[string]string{eventSecretHeader: "wrong"}); status != 403 {
+        t.Errorf("wrong secret: %d", status)
+    }
+    if status, body := post(t, h, "/events/ec2", event, map[string]string{eventSecretHeader: "s3cret"}); status != 200 {
+        t.Errorf("trusted event: %d %s", status, body)
+    }
+    if _, body := get(t, h, "/ec2/ip?name=web"); body != "" {
+        t.Errorf("web still answered after a trusted termination: %q", body)
+    }
+}
+
+const sharedNameInventory = `{
+    "instances": [
+        {"ID": "i-0000000000000001", "Name": "Web", "State": "running", "LaunchTime": "2024-01-01T00:00:00Z", "PrivateIP": "10.0.1.1"},
+        {"ID": "i-0000000000000002", "Name": "Web", "State": "running", "LaunchTime": "2024-02-01T00:00:00Z", "PrivateIP": "10.0.1.2"},
+        {"ID": "i-0000000000000003", "Name": "db", "State": "running", "PrivateIP": "10.0.2.1"}
+    ]
+}`
+
+func TestNameConflicts(t *testing.T) {
+    h := newTestHandler(t, aws.Config{UniqueNames: "index,id"}, sharedNameInventory)
+
+    status, body := get(t, h, "/ec2/conflicts")
+    if status != 200 {
+        t.Fatalf("conflicts: %d %s", status, body)
+    }
+    var conflicts []aws.NameConflict
+    if err := json.Unmarshal([]byte(body), &conflicts); err != nil {
+        t.Fatal(err)
+    }
+    if len(conflicts) != 1 || conflicts[0].Name != "web" || len(conflicts[0].Instances) != 2 || len(conflicts[0].Selected) != 2 {
+        t.Fatalf("conflicts: %+v", conflicts)
+    }
+    // Every advertised unique name resolves to its instance, in any case.
+    for i, member := range conflicts[0].Instances {
+        want := fmt.Sprintf("10.0.1.%d\n", i + 1)
+        if member.UniqueName != fmt.Sprintf("web-%d", i + 1) {
+            t.Errorf("member %d: unique name %q", i, member.UniqueName)
+        }
+        for _, name := range []string{member.UniqueName, strings.ToUpper(member.UniqueName), member.ID} {
+            if _, body := get(t, h, "/ec2/ip?name=" + name); body != want {
+                t.Errorf("%s: %q, want %q", name, body, want)
+            }
+        }
+    }
+    if _, body := get(t, h, "/ec2/ip?name=Web"); body != "10.0.1.1\n10.0.1.2\n" {
+        t.Errorf("shared name: %q", body)
+    }
+}
+
+func TestDuplicateNamePolicies(t *testing.T) {
+    for _, test := range []struct {
+        policy string
+        status int
+        body   string
+    }{
+        {"newest", 200, "10.0.1.2\n"},
+        {"oldest", 200, "10.0.1.1\n"},
+        {"error", 409, ""},
+    } {
+        h := newTestHandler(t, aws.Config{DuplicateNames: test.policy}, sharedNameInventory)
+        status, body := get(t, h, "/ec2/ip?name=Web")
+        if status != test.status || (status == 200 && body != test.body) {
+            t.Errorf("%s: got %d %q, want %d %q", test.policy, status, body, test.status, test.body)
+        }
+        if _, body := get(t, h, "/ec2/ip?name=db"); body != "10.0.2.1\n" {
+            t.Errorf("%s: unshared name: %q", test.policy, body)
+        }
+    }
+}
+
+func TestEC2InstancesSelector(t *testing.T) {
+    h := newTestHandler(t, aws.Config{}, testInventory)
+
+    for _, test := range []struct {
+        path   string
+        status int
+        ids    []string
+    }{
+        {"/ec2/instances?selector=Role=web", 200, []string{"i-0000000000000001"}},
+        {"/ec2/instances?selector=Env=prod", 200, []string{"i-0000000000000001"}},
+        {"/ec2/instances?selector=Env=prod&states=all", 200, []string{"i-0000000000000001", "i-0000000000000002"}},
+        {"/ec2/instances?selector=Role+in+(db,cache),@state=stopped&states=all", 200, []string{"i-0000000000000002"}},
+        {"/ec2/instances?selector=!Role&states=all", 200, []string{}},
+        {"/ec2/instances?selector=Role+in+(web", 400, nil},
+        {"/ec2/instances?selector=@bogus=1", 400, nil},
+        {"/ec2/instances?selector=Role=web&states=bogus", 400, nil},
+    } {
+        status, body := get(t, h, test.path)
+        if status != test.status {
+            t.Errorf("%s: got %d %s, want %d", test.path, status, body, test.status)
+            continue
+        }
+        if status != 200 {
+            continue
+        }
+        var instances []aws.EC2Instance
+        if err := json.Unmarshal([]byte(body), &instances); err != nil {
+            t.Fatalf("%s: %s", test.path, err.Error())
+        }
+        ids := make([]string, 0, len(instances))
+        for _, inst := range instances {
+            ids = append(ids, inst.ID)
+        }
+        if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+            t.Errorf("%s: got %v, want %v", test.path, ids, test.ids)
+        }
+    }
+}
+
+const asgInventory = `{
+    "instances": [
+        {"ID": "i-1", "Name": "web-1", "State": "running", "PrivateIP": "10.0.1.1"},
+        {"ID": "i-2", "Name": "web-2", "State": "running", "PrivateIP": "10.0.1.2"},
+        {"ID": "i-3", "Name": "web-3", "State": "running", "PrivateIP": "10.0.1.3"},
+        {"ID": "i-4", "Name": "web-4", "State": "running", "PrivateIP": "10.0.1.4"}
+    ],
+    "autoScalingGroups": [
+        {"Name": "Web-ASG", "Instances": [
+            {"ID": "i-1", "LifecycleState": "InService", "HealthStatus": "Healthy"},
+            {"ID": "i-2", "LifecycleState": "InService", "HealthStatus": "Unhealthy"},
+            {"ID": "i-3", "LifecycleState": "Pending", "HealthStatus": "Healthy"},
+            {"ID": "i-4", "LifecycleState": "Terminating:Wait", "HealthStatus": "Healthy"}
+        ]}
+    ]
+}`
+
+func TestASGInstances(t *testing.T) {
+    h := newTestHandler(t, aws.Config{}, asgInventory)
+
+    for _, test := range []struct {
+        path string
+        ids  string
+    }{
+        {"/asg/instances?name=Web-ASG", "i-1"},
+        {"/asg/instances?name=web-asg", "i-1"},
+        {"/asg/instances?name=web-asg&healthy=false", "i-1,i-2,i-3,i-4"},
+        {"/asg/instances?name=other", ""},
+    } {
+        status, body := get(t, h, test.path)
+        if status != 200 {
+            t.Errorf("%s: %d %s", test.path, status, body)
+            continue
+        }
+        var instances []aws.EC2Instance
+        if err := json.Unmarshal([]byte(body), &instances); err != nil {
+            t.Fatalf("%s: %s", test.path, err.Error())
+        }
+        ids := make([]string, 0, len(instances))
+        for _, inst := range instances {
+            ids = append(ids, inst.ID)
+        }
+        if strings.Join(ids, ",") != test.ids {
+            t.Errorf("%s: got %v, want %s", test.path, ids, test.ids)
+        }
+    }
+}
+
+func TestECSTasksIgnoreCase(t *testing.T) {
+    inventory := `{
+        "ecsClusters": [{"Name": "Prod"}],
+        "ecsTasks": [
+            {"ID": "t-1", "Cluster": "Prod", "Service": "Web", "IPs": ["10.0.5.1"]},
+            {"ID": "t-2", "Cluster": "Prod", "Service": "Worker", "IPs": ["10.0.5.2"]}
+        ]
+    }`
+    h := newTestHandler(t, aws.Config{}, inventory)
+
+    for _, test := range []struct {
+        path string
+        ids  string
+    }{
+        {"/ecs/tasks?service=web", "t-1"},
+        {"/ecs/tasks?service=WEB&cluster=prod", "t-1"},
+        {"/ecs/tasks?cluster=PROD", "t-1,t-2"},
+        {"/ecs/tasks?service=db", ""},
+    } {
+        status, body := get(t, h, test.path)
+        if status != 200 {
+            t.Errorf("%s: %d %s", test.path, status, body)
+            continue
+        }
+        var tasks []aws.ECSTask
+        if err := json.Unmarshal([]byte(body), &tasks); err != nil {
+            t.Fatalf("%s: %s", test.path, err.Error())
+        }
+        ids := make([]string, 0, len(tasks))
+        for _, task := range tasks {
+            ids = append(ids, task.ID)
+        }
+        if strings.Join(ids, ",") != test.ids {
+            t.Errorf("%s: got %v, want %s", test.path, ids, test.ids)
+        }
+    }
+    if _, body := get(t, h, "/ecs/clusters?cluster=prod"); !strings.Contains(body, `"Prod"`) {
+        t.Errorf("cluster by lower-case name: %s", body)
+    }
+}
@@ -20,6 +20,7 @@ func NewService(c Config) *Service {
         Handler: NewHandler(),
         logger: log.New(os.Stderr, "[httpd] ", log.LstdFlags),
     }
+    s.Handler.EventSecret = c.EventSecret
     return s
 }
 
@@ -1,11 +1,25 @@
 package named
 
 type Config struct {
-    Enabled bool
-    Addr    string
-    Net     string
-    Domain  string
-    Host    string
-    Mbox    string
-    Ttl     uint32
+    Enabled       bool
+    Addr          string
+    Net           string
+    Domain        string
+    Host          string
+    Mbox          string
+    Ttl           uint32
+    NegativeTtl   uint32
+    RDSZone       string
+    ELBZone       string
+    ASGZone       string
+    ECSZone       string
+    GroupZone     string
+    Group         []string
+    ReverseZone   []string
+    ReverseVPC    bool
+    SRVTag        string
+    TXTTag        []string
+    ClientSubnet  bool
+    DefaultAnswer string
+    Views         map[string]*ViewConfig
 }
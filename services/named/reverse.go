@@ -0,0 +1,203 @@
+package named
+
+import (
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+
+    "github.com/miekg/dns"
+    "github.com/page31/aws-meta-server/services/aws"
+)
+
+const (
+    reverseZoneIPv4 = "in-addr.arpa."
+    reverseZoneIPv6 = "ip6.arpa."
+)
+
+// parseReverseZones reads the ReverseZone CIDRs.
+func parseReverseZones(cidrs []string) (error, []*net.IPNet) {
+    nets := make([]*net.IPNet, 0, len(cidrs))
+    for _, cidr := range cidrs {
+        _, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+        if err != nil {
+            return fmt.Errorf("bad ReverseZone %q: %s", cidr, err.Error()), nil
+        }
+        nets = append(nets, ipNet)
+    }
+    return nil, nets
+}
+
+// handleReverse answers PTR queries for addresses inside the configured
+// ranges, and the VPC CIDRs when ReverseVPC is set, with a name resolving
+// to the instance owning the address alone. Shorter names inside a range's
+// reverse zone exist without records of their own and get NODATA. Anything
+// outside is refused as the server is not authoritative for it.
+func (s *Service) handleReverse(w dns.ResponseWriter, r *dns.Msg) {
+    reply := new(dns.Msg)
+    reply.SetReply(r)
+    for _, q := range r.Question {
+        prefix := reversePrefix(q.Name)
+        ipNet := s.reverseNet(prefix)
+        if ipNet == nil {
+            reply.Rcode = dns.RcodeRefused
+            break
+        }
+        reply.Authoritative = true
+        zone := reverseZoneName(ipNet)
+        if ones, bits := prefix.Mask.Size(); ones < bits {
+            if q.Qtype == dns.TypeSOA && strings.EqualFold(dns.Fqdn(q.Name), zone) {
+                reply.Answer = append(reply.Answer, s.soaFor(zone, s.Config.Ttl))
+            } else {
+                reply.Ns = append(reply.Ns, s.soaFor(zone, s.Config.NegativeTtl))
+            }
+            continue
+        }
+        ip := prefix.IP
+        answers := s.answerPTR(q, ip)
+        if len(answers) > 0 {
+            reply.Answer = append(reply.Answer, answers...)
+            continue
+        }
+        if err, _ := s.AWSService.GetEC2NameFromIP(ip.String()); err != nil {
+            reply.Rcode = dns.RcodeNameError
+        }
+        reply.Ns = append(reply.Ns, s.soaFor(zone, s.Config.NegativeTtl))
+    }
+    writeReply(w, r, reply)
+}
+
+func (s *Service) answerPTR(q dns.Question, ip net.IP) []dns.RR {
+    if q.Qtype != dns.TypePTR && q.Qtype != dns.TypeANY {
+        return nil
+    }
+    err, name := s.AWSService.GetEC2HostnameFromIP(ip.String())
+    if err != nil || name == "" {
+        return nil
+    }
+    target := dns.Fqdn(name + "." + s.Config.Domain)
+    if _, ok := dns.IsDomainName(target); !ok {
+        return nil
+    }
+    return []dns.RR{&dns.PTR{
+        Hdr: dns.RR_Header{
+            Name: q.Name,
+            Class: dns.ClassINET,
+            Rrtype: dns.TypePTR,
+            Ttl: s.Config.Ttl,
+        },
+        Ptr: target,
+    }}
+}
+
+// reverseNet returns the configured or VPC range whose reverse zone holds
+// the name of prefix: an address inside the range, or a shorter name
+// between the zone apex and the range.
+func (s *Service) reverseNet(prefix *net.IPNet) *net.IPNet {
+    if prefix == nil {
+        return nil
+    }
+    ones, _ := prefix.Mask.Size()
+    for _, ipNet := range s.reverseRanges() {
+        if ones < reverseZoneBits(ipNet) {
+            continue
+        }
+        if ipNet.Contains(prefix.IP) || prefix.Contains(ipNet.IP) {
+            return ipNet
+        }
+    }
+    return nil
+}
+
+// reverseRanges lists the configured ranges and, when ReverseVPC is set,
+// the VPC CIDRs.
+func (s *Service) reverseRanges() []*net.IPNet {
+    if !s.Config.ReverseVPC {
+        return s.reverseNets
+    }
+    ranges := append([]*net.IPNet(nil), s.reverseNets...)
+    for _, vpc := range s.AWSService.GetVPCs(aws.Scope{}) {
+        for _, cidr := range append(append([]string(nil), vpc.CIDRs...), vpc.IPv6CIDRs...) {
+            if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+                ranges = append(ranges, ipNet)
+            }
+        }
+    }
+    return ranges
+}
+
+// reversePrefix parses an in-addr.arpa or ip6.arpa name into the network
+// its labels spell out, a /32 or /128 for a full address and a shorter
+// prefix for anything above one such as a zone apex.
+func reversePrefix(name string) *net.IPNet {
+    name = strings.ToLower(dns.Fqdn(name))
+    var labels []string
+    var size, width int
+    switch {
+    case strings.HasSuffix(name, "." + reverseZoneIPv4):
+        labels = strings.Split(strings.TrimSuffix(name, "." + reverseZoneIPv4), ".")
+        size, width = net.IPv4len, 8
+    case strings.HasSuffix(name, "." + reverseZoneIPv6):
+        labels = strings.Split(strings.TrimSuffix(name, "." + reverseZoneIPv6), ".")
+        size, width = net.IPv6len, 4
+    default:
+        return nil
+    }
+    if len(labels) * width > size * 8 {
+        return nil
+    }
+    ip := make(net.IP, size)
+    for i, label := range labels {
+        pos := len(labels) - 1 - i
+        if width == 8 {
+            b, err := strconv.ParseUint(label, 10, 8)
+            if err != nil {
+                return nil
+            }
+            ip[pos] = byte(b)
+            continue
+        }
+        nibble, err := strconv.ParseUint(label, 16, 4)
+        if err != nil || len(label) != 1 {
+            return nil
+        }
+        if pos % 2 == 0 {
+            ip[pos / 2] |= byte(nibble) << 4
+        } else {
+            ip[pos / 2] |= byte(nibble)
+        }
+    }
+    return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(labels) * width, size * 8)}
+}
+
+// reverseZoneBits is the prefix length of the reverse zone apex covering
+// ipNet, its prefix rounded down to a whole octet or nibble.
+func reverseZoneBits(ipNet *net.IPNet) int {
+    ones, bits := ipNet.Mask.Size()
+    if bits == 8 * net.IPv4len {
+        return ones - ones % 8
+    }
+    return ones - ones % 4
+}
+
+// reverseZoneName is the apex of the reverse zone covering ipNet, the
+// prefix rounded down to a whole octet or nibble.
+func reverseZoneName(ipNet *net.IPNet) string {
+    ones, bits := ipNet.Mask.Size()
+    if ip4 := ipNet.IP.To4(); ip4 != nil && bits == 8 * net.IPv4len {
+        labels := make([]string, 0, net.IPv4len)
+        for i := ones / 8 - 1; i >= 0; i-- {
+            labels = append(labels, strconv.Itoa(int(ip4[i])))
+        }
+        return strings.Join(append(labels, reverseZoneIPv4), ".")
+    }
+    labels := make([]string, 0, net.IPv6len * 2)
+    for i := ones / 4 - 1; i >= 0; i-- {
+        b := ipNet.IP[i / 2]
+        if i % 2 == 0 {
+            b >>= 4
+        }
+        labels = append(labels, strconv.FormatUint(uint64(b & 0xf), 16))
+    }
+    return strings.Join(append(labels, reverseZoneIPv6), ".")
+}
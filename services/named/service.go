@@ -1,6 +1,7 @@
 package named
 
 import (
+    "fmt"
     "log"
     "os"
     "strings"
@@ -14,16 +15,31 @@ import (
     "sync/atomic"
 )
 
+const (
+    defaultRDSZone     = "rds"
+    defaultELBZone     = "elb"
+    defaultASGZone     = "asg"
+    defaultECSZone     = "ecs"
+    defaultGroupZone   = "group"
+    defaultNegativeTtl = 60
+    rdsReaderLabel     = "reader"
+    maxCNAMEChain      = 8
+)
+
 var (
     errBadNetType = errors.New("Bad net type")
     seq = rand.Uint32()
 )
 
 type Service struct {
-    Config     *Config
-    logger     *log.Logger
-    AWSService *aws.Service
-    server     *dns.Server
+    Config      *Config
+    logger      *log.Logger
+    AWSService  *aws.Service
+    server      *dns.Server
+    groups      map[string]aws.Selector
+    reverseNets []*net.IPNet
+    views       []*view
+    defaultView *view
 }
 
 func NewService(c Config) *Service {
@@ -37,16 +53,41 @@ func NewService(c Config) *Service {
     if !strings.HasSuffix(c.Host, ".") {
         c.Host += "."
     }
+    if c.RDSZone == "" {
+        c.RDSZone = defaultRDSZone
+    }
+    if c.ELBZone == "" {
+        c.ELBZone = defaultELBZone
+    }
+    if c.ASGZone == "" {
+        c.ASGZone = defaultASGZone
+    }
+    if c.ECSZone == "" {
+        c.ECSZone = defaultECSZone
+    }
+    if c.GroupZone == "" {
+        c.GroupZone = defaultGroupZone
+    }
+    if c.NegativeTtl == 0 {
+        c.NegativeTtl = defaultNegativeTtl
+    }
     s := &Service{
         Config: &c,
         logger: log.New(os.Stderr, "[named] ", log.LstdFlags),
         server: &dns.Server{Addr: c.Addr, Net: strings.ToLower(c.Net), Handler: mux},
     }
     mux.HandleFunc(c.Domain, s.handle)
+    if len(c.ReverseZone) > 0 || c.ReverseVPC {
+        mux.HandleFunc(reverseZoneIPv4, s.handleReverse)
+        mux.HandleFunc(reverseZoneIPv6, s.handleReverse)
+    }
     return s
 }
 
 func (s *Service) Open() error {
+    if err := s.parseConfig(); err != nil {
+        return err
+    }
     if err := s.listen(); err != nil {
         return err
     }
@@ -59,6 +100,45 @@ func (s *Service) Open() error {
     return nil
 }
 
+// parseConfig reads the settings that need more than a default.
+func (s *Service) parseConfig() error {
+    err, groups := parseGroups(s.Config.Group)
+    if err != nil {
+        return err
+    }
+    s.groups = groups
+    err, reverseNets := parseReverseZones(s.Config.ReverseZone)
+    if err != nil {
+        return err
+    }
+    s.reverseNets = reverseNets
+    err, views, defaultView := parseViews(s.Config)
+    if err != nil {
+        return err
+    }
+    s.views = views
+    s.defaultView = defaultView
+    return nil
+}
+
+// parseGroups reads "name: selector" entries, each answering
+// <name>.<GroupZone> with the instances the selector matches.
+func parseGroups(entries []string) (error, map[string]aws.Selector) {
+    groups := make(map[string]aws.Selector, len(entries))
+    for _, entry := range entries {
+        idx := strings.Index(entry, ":")
+        if idx <= 0 {
+            return fmt.Errorf("bad Group %q: expected \"name: selector\"", entry), nil
+        }
+        err, selector := aws.ParseSelector(entry[idx + 1:])
+        if err != nil {
+            return fmt.Errorf("bad Group %q: %s", entry, err.Error()), nil
+        }
+        groups[strings.ToLower(strings.TrimSpace(entry[:idx]))] = selector
+    }
+    return nil, groups
+}
+
 func (s *Service) listen() error {
     srv := s.server
     addr := srv.Addr
@@ -114,69 +194,353 @@ func (s *Service) handle(w dns.ResponseWriter, r *dns.Msg) {
     reply := new(dns.Msg)
     reply.SetReply(r)
     reply.Authoritative = true
+    v, subnet := s.clientView(w, r)
+    setSubnet(reply, r, subnet)
     for _, q := range r.Question {
-        answers := s.answer(q)
+        answers, exists := s.resolve(q, v)
+        reply.Answer = append(reply.Answer, answers...)
         if len(answers) > 0 {
-            reply.Answer = append(reply.Answer, answers...)
-        } else {
-            reply.Ns = append(reply.Ns, s.soa(q))
+            continue
+        }
+        // Negative answers carry the SOA so resolvers know how long to
+        // cache them (RFC 2308), NXDOMAIN for names that do not exist at
+        // all and NODATA, a NOERROR without answers, for names that only
+        // lack the requested type.
+        if !exists {
+            reply.Rcode = dns.RcodeNameError
         }
+        reply.Ns = append(reply.Ns, s.soaFor(s.Config.Domain, s.Config.NegativeTtl))
     }
+    writeReply(w, r, reply)
+}
+
+// writeReply truncates the reply to what the client can receive, the EDNS
+// buffer size or 512 bytes over UDP, setting TC so large groups are asked
+// for again over TCP.
+func writeReply(w dns.ResponseWriter, r *dns.Msg, reply *dns.Msg) {
+    size := dns.MaxMsgSize
+    if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+        size = dns.MinMsgSize
+        if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+            size = int(opt.UDPSize())
+        }
+    }
+    reply.Truncate(size)
     w.WriteMsg(reply)
 }
 
-func (s *Service) answer(q dns.Question) (answers []dns.RR) {
-    name := strings.TrimSuffix(q.Name, s.Config.Domain)
-    if name != "" && strings.HasSuffix(name, "."){
-        name = name[0:len(name) - 1]
+// resolve answers a question and follows CNAMEs that point back into the
+// domain, so clients get the final records in the same response.
+func (s *Service) resolve(q dns.Question, v *view) ([]dns.RR, bool) {
+    if q.Qtype == dns.TypeANY {
+        return s.answerAny(q, v)
     }
-    instances := s.AWSService.GetEC2FromName(name)
-    for _, inst := range instances {
-        var target string
-        ttl := s.Config.Ttl
-        hdr := dns.RR_Header{
-            Name: q.Name,
-            Class: dns.ClassINET,
-            Rrtype: q.Qtype,
-            Ttl: ttl,
+    answers, exists := s.answer(q, v)
+    seen := map[string]bool{strings.ToLower(q.Name): true}
+    for depth := 0; depth < maxCNAMEChain && q.Qtype != dns.TypeCNAME && len(answers) > 0; depth++ {
+        cname, ok := answers[len(answers) - 1].(*dns.CNAME)
+        if !ok || !s.inZone(cname.Target) || seen[strings.ToLower(cname.Target)] {
+            break
+        }
+        seen[strings.ToLower(cname.Target)] = true
+        chased, _ := s.answer(dns.Question{Name: cname.Target, Qtype: q.Qtype, Qclass: q.Qclass}, v)
+        answers = append(answers, chased...)
+    }
+    return answers, exists
+}
+
+// answerAny gives the minimal response of RFC 8482 to ANY queries, the
+// first record set the name has instead of all of them, or a synthesized
+// HINFO when it has none of the usual types.
+func (s *Service) answerAny(q dns.Question, v *view) ([]dns.RR, bool) {
+    exists := false
+    for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypeSOA} {
+        answers, found := s.resolve(dns.Question{Name: q.Name, Qtype: qtype, Qclass: q.Qclass}, v)
+        if len(answers) > 0 {
+            return answers, true
+        }
+        exists = exists || found
+    }
+    if !exists {
+        return nil, false
+    }
+    return []dns.RR{&dns.HINFO{
+        Hdr: s.header(q, dns.TypeHINFO),
+        Cpu: "RFC8482",
+    }}, true
+}
+
+func (s *Service) inZone(name string) bool {
+    name = strings.ToLower(dns.Fqdn(name))
+    domain := strings.ToLower(s.Config.Domain)
+    return name == domain || strings.HasSuffix(name, "." + domain)
+}
+
+// answer returns the records for a question as the client's view sees them
+// and whether its name exists, which tells NXDOMAIN from NODATA when there
+// are no records.
+func (s *Service) answer(q dns.Question, v *view) ([]dns.RR, bool) {
+    if !s.inZone(q.Name) {
+        return nil, false
+    }
+    name := dns.Fqdn(q.Name)
+    name = name[:len(name) - len(s.Config.Domain)]
+    name = strings.TrimSuffix(name, ".")
+    if name == "" {
+        return s.answerApex(q), true
+    }
+    for _, zone := range []string{s.Config.RDSZone, s.Config.ELBZone, s.Config.ASGZone, s.Config.ECSZone, s.Config.GroupZone} {
+        if strings.EqualFold(name, zone) {
+            // The sub-zones exist as empty non-terminals.
+            return nil, true
         }
-        if inst.PubicDNS != "" {
-            hdr.Rrtype = dns.TypeCNAME
-            target = inst.PubicDNS
-            if !strings.HasSuffix(target, ".") {
-                target += "."
+    }
+    if sub, ok := subZoneName(name, s.Config.RDSZone); ok {
+        return s.answerRDS(q, sub)
+    }
+    if sub, ok := subZoneName(name, s.Config.ELBZone); ok {
+        return s.answerELB(q, sub)
+    }
+    if sub, ok := subZoneName(name, s.Config.ASGZone); ok {
+        return s.answerASG(q, sub, v)
+    }
+    if sub, ok := subZoneName(name, s.Config.ECSZone); ok {
+        return s.answerECS(q, sub)
+    }
+    if sub, ok := subZoneName(name, s.Config.GroupZone); ok {
+        return s.answerGroup(q, sub, v)
+    }
+    if strings.HasPrefix(name, "_") {
+        return s.answerSRV(q, name)
+    }
+    return s.answerEC2(q, name, v)
+}
+
+// answerApex answers the domain itself with its SOA and NS records.
+func (s *Service) answerApex(q dns.Question) (answers []dns.RR) {
+    if q.Qtype == dns.TypeSOA {
+        answers = append(answers, s.soaFor(s.Config.Domain, s.Config.Ttl))
+    }
+    if q.Qtype == dns.TypeNS {
+        answers = append(answers, &dns.NS{
+            Hdr: s.header(q, dns.TypeNS),
+            Ns: s.Config.Host,
+        })
+    }
+    return answers
+}
+
+// subZoneName strips a sub-zone such as "rds" from a name relative to the
+// domain, reporting whether the name was inside it.
+func subZoneName(name string, zone string) (string, bool) {
+    name = strings.ToLower(name)
+    zone = strings.ToLower(zone)
+    if !strings.HasSuffix(name, "." + zone) {
+        return "", false
+    }
+    return strings.TrimSuffix(name, "." + zone), true
+}
+
+// answerRDS answers <db>.<zone> with the database or cluster writer
+// endpoint and reader.<cluster>.<zone> with the cluster reader endpoint.
+func (s *Service) answerRDS(q dns.Question, name string) ([]dns.RR, bool) {
+    reader := false
+    if strings.HasPrefix(name, rdsReaderLabel + ".") {
+        reader = true
+        name = strings.TrimPrefix(name, rdsReaderLabel + ".")
+    }
+    databases := s.AWSService.GetRDSFromName(name, aws.Scope{})
+    if len(databases) == 0 {
+        return nil, false
+    }
+    target := databases[0].Endpoint
+    if reader {
+        target = databases[0].ReaderEndpoint
+    }
+    return s.cname(q, target), true
+}
+
+// answerELB answers <lb-name>.<zone> with the load balancer's AWS hostname.
+func (s *Service) answerELB(q dns.Question, name string) ([]dns.RR, bool) {
+    lbs := s.AWSService.GetLoadBalancerFromName(name, aws.Scope{})
+    if len(lbs) == 0 {
+        return nil, false
+    }
+    return s.cname(q, lbs[0].DNSName), true
+}
+
+// answerASG answers <asg>.<zone> with the addresses of every healthy member
+// so clients round-robin across the group.
+func (s *Service) answerASG(q dns.Question, name string, v *view) (answers []dns.RR, exists bool) {
+    if len(s.AWSService.GetAutoScalingGroups(name, aws.Scope{})) == 0 {
+        return nil, false
+    }
+    for _, inst := range s.AWSService.GetASGInstances(name, aws.Scope{}, true) {
+        answers = append(answers, s.addresses(q, v.instanceIPs(inst))...)
+    }
+    return answers, true
+}
+
+// answerECS answers names under the ECS zone:
+//   _<port-name>._<proto>.<service>.<cluster>  SRV for every task port
+//   <task-id>.<service>.<cluster>              A/AAAA for the task
+//   <service>.<cluster>                        A/AAAA for every task
+// <cluster> and _<proto>.<service>.<cluster> exist without records when
+// there are names beneath them.
+func (s *Service) answerECS(q dns.Question, name string) (answers []dns.RR, exists bool) {
+    labels := strings.Split(name, ".")
+    if len(labels) == 1 {
+        return nil, len(s.AWSService.GetECSTasks(labels[0], "", aws.Scope{})) > 0
+    }
+    if len(labels) == 3 && strings.HasPrefix(labels[0], "_") {
+        protocol := strings.TrimPrefix(labels[0], "_")
+        for _, task := range s.AWSService.GetECSTasks(labels[2], labels[1], aws.Scope{}) {
+            for _, port := range task.Ports {
+                if len(task.IPs) > 0 && port.Name != "" && strings.EqualFold(port.Protocol, protocol) {
+                    return nil, true
+                }
             }
-        } else if q.Qtype == dns.TypeA {
-            target = inst.PublicIP
-            if target == "" {
-                target = inst.PrivateIP
+        }
+        return nil, false
+    }
+    if len(labels) == 4 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_") {
+        portName := strings.TrimPrefix(labels[0], "_")
+        protocol := strings.TrimPrefix(labels[1], "_")
+        service, cluster := labels[2], labels[3]
+        for _, task := range s.AWSService.GetECSTasks(cluster, service, aws.Scope{}) {
+            if len(task.IPs) == 0 {
+                continue
+            }
+            target := dns.Fqdn(strings.Join([]string{strings.ToLower(task.ID), service, cluster, s.Config.ECSZone}, ".") + "." + s.Config.Domain)
+            for _, port := range task.Ports {
+                if !strings.EqualFold(port.Name, portName) || !strings.EqualFold(port.Protocol, protocol) {
+                    continue
+                }
+                exists = true
+                if q.Qtype != dns.TypeSRV {
+                    continue
+                }
+                answers = append(answers, &dns.SRV{
+                    Hdr: s.header(q, dns.TypeSRV),
+                    Priority: 0,
+                    Weight: 1,
+                    Port: uint16(port.Port),
+                    Target: target,
+                })
             }
         }
-        if target == "" {
+        return answers, exists
+    }
+    var taskID string
+    switch len(labels) {
+    case 3:
+        taskID = labels[0]
+        labels = labels[1:]
+    case 2:
+    default:
+        return nil, false
+    }
+    for _, task := range s.AWSService.GetECSTasks(labels[1], labels[0], aws.Scope{}) {
+        if taskID != "" && !strings.EqualFold(taskID, task.ID) {
             continue
         }
-        if hdr.Rrtype == dns.TypeCNAME {
-            answers = append(answers, &dns.CNAME{
-                Hdr: hdr,
-                Target: target,
-            })
-        } else if (hdr.Rrtype == dns.TypeA) {
+        exists = true
+        answers = append(answers, s.addresses(q, task.IPs)...)
+    }
+    return answers, exists
+}
+
+// answerGroup answers <group>.<zone> with the addresses of every instance
+// matching the group's selector.
+func (s *Service) answerGroup(q dns.Question, name string, v *view) (answers []dns.RR, exists bool) {
+    selector, ok := s.groups[name]
+    if !ok {
+        return nil, false
+    }
+    for _, inst := range s.AWSService.SelectEC2Instances(selector, aws.Scope{}) {
+        answers = append(answers, s.addresses(q, v.instanceIPs(inst))...)
+    }
+    return answers, true
+}
+
+func (s *Service) header(q dns.Question, rrtype uint16) dns.RR_Header {
+    return dns.RR_Header{
+        Name: q.Name,
+        Class: dns.ClassINET,
+        Rrtype: rrtype,
+        Ttl: s.Config.Ttl,
+    }
+}
+
+// addresses answers A queries with the IPv4 and AAAA queries with the
+// IPv6 addresses among ips, and anything else with nothing.
+func (s *Service) addresses(q dns.Question, ips []string) (answers []dns.RR) {
+    for _, value := range ips {
+        ip := net.ParseIP(value)
+        if ip == nil {
+            continue
+        }
+        if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
             answers = append(answers, &dns.A{
-                Hdr: hdr,
-                A: net.ParseIP(target),
+                Hdr: s.header(q, dns.TypeA),
+                A: ip4,
+            })
+        } else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+            answers = append(answers, &dns.AAAA{
+                Hdr: s.header(q, dns.TypeAAAA),
+                AAAA: ip,
             })
         }
     }
     return answers
 }
 
-func (s *Service) soa(q dns.Question) dns.RR {
+func (s *Service) cname(q dns.Question, target string) []dns.RR {
+    if target == "" {
+        return nil
+    }
+    return []dns.RR{&dns.CNAME{
+        Hdr: s.header(q, dns.TypeCNAME),
+        Target: dns.Fqdn(target),
+    }}
+}
+
+// answerEC2 answers an instance name with a CNAME to its public DNS name in
+// public-cname views, or with the addresses of every instance sharing the
+// name as a CNAME must be the only record of its owner. Instances with IPv6
+// addresses or TXT tags answer with their addresses too, AWS public names
+// have neither. A shared name the duplicate policy refuses to pick from
+// exists but has no records.
+func (s *Service) answerEC2(q dns.Question, name string, v *view) (answers []dns.RR, exists bool) {
+    err, instances := s.AWSService.ResolveEC2Name(s.AWSService.ResolveScopedName(name))
+    if err == aws.DuplicateNameError {
+        return nil, true
+    }
+    if len(instances) == 0 {
+        return nil, s.AWSService.HasEC2NamesBelow(name)
+    }
+    if v.answer == AnswerPublicCNAME && len(instances) == 1 && instances[0].PublicDNS != "" && len(instances[0].IPv6Addresses) == 0 && len(s.tagStrings(instances[0])) == 0 {
+        return s.cname(q, instances[0].PublicDNS), true
+    }
+    if q.Qtype == dns.TypeTXT {
+        for _, inst := range instances {
+            answers = append(answers, s.txt(q, inst)...)
+        }
+        return answers, true
+    }
+    for _, inst := range instances {
+        answers = append(answers, s.addresses(q, v.instanceIPs(inst))...)
+    }
+    return answers, true
+}
+
+func (s *Service) soaFor(zone string, ttl uint32) dns.RR {
     return &dns.SOA{
         Hdr:     dns.RR_Header{
-            Name: s.Config.Domain,
+            Name: zone,
             Rrtype: dns.TypeSOA,
             Class: dns.ClassINET,
-            Ttl: 60,
+            Ttl: ttl,
         },
         Ns:      s.Config.Host,
         Mbox:    s.Config.Mbox,
@@ -184,6 +548,6 @@ func (s *Service) soa(q dns.Question) dns.RR {
         Refresh: 300,
         Retry:   300,
         Expire:  300,
-        Minttl:  60,
+        Minttl:  s.Config.NegativeTtl,
     }
 }
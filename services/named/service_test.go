@@ -0,0 +1,527 @@
+package named
+
+import (
+    "fmt"
+    "io/ioutil"
+    "net"
+    "path/filepath"
+    "sort"
+    "strings"
+    "testing"
+
+    "github.com/miekg/dns"
+    "github.com/page31/aws-meta-server/services/aws"
+)
+
+// testWriter records the reply instead of sending it.
+type testWriter struct {
+    remote net.Addr
+    reply  *dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+    return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testWriter) RemoteAddr() net.Addr {
+    return w.remote
+}
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+    w.reply = m
+    return nil
+}
+
+func (w *testWriter) Write(b []byte) (int, error) {
+    return len(b), nil
+}
+
+func (w *testWriter) Close() error {
+    return nil
+}
+
+func (w *testWriter) TsigStatus() error {
+    return nil
+}
+
+func (w *testWriter) TsigTimersOnly(bool) {
+}
+
+func (w *testWriter) Hijack() {
+}
+
+// newTestService answers from a static inventory without listening.
+func newTestService(t *testing.T, c Config, awsConfig aws.Config, inventory string) *Service {
+    file := filepath.Join(t.TempDir(), "inventory.json")
+    if err := ioutil.WriteFile(file, []byte(inventory), 0644); err != nil {
+        t.Fatal(err)
+    }
+    awsConfig.Inventory = aws.InventoryStatic
+    awsConfig.InventoryFile = file
+    awsConfig.RefreshInterval = "1h"
+    awsConfig.SRVTag = c.SRVTag
+    awsService := aws.NewService(awsConfig)
+    if err := awsService.Open(); err != nil {
+        t.Fatalf("open: %s", err.Error())
+    }
+    t.Cleanup(func() { awsService.Close() })
+    if c.Domain == "" {
+        c.Domain = "example.com"
+    }
+    c.Host = "localhost"
+    c.Mbox = "admin.example.com"
+    c.Ttl = 600
+    s := NewService(c)
+    s.AWSService = awsService
+    if err := s.parseConfig(); err != nil {
+        t.Fatalf("parse config: %s", err.Error())
+    }
+    return s
+}
+
+// exchange sends a query through the server's mux from a UDP client.
+func exchange(s *Service, m *dns.Msg, remote net.Addr) *dns.Msg {
+    w := &testWriter{remote: remote}
+    s.server.Handler.ServeDNS(w, m)
+    return w.reply
+}
+
+func query(s *Service, name string, qtype uint16) *dns.Msg {
+    m := new(dns.Msg)
+    m.SetQuestion(dns.Fqdn(name), qtype)
+    return exchange(s, m, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353})
+}
+
+// groupInventory lists n instances all tagged Role=web.
+func groupInventory(n int) string {
+    instances := make([]string, 0, n)
+    for i := 1; i <= n; i++ {
+        instances = append(instances, fmt.Sprintf(`{"ID": "i-%d", "Name": "web-%d", "State": "running", "Tags": {"Role": "web"}, "PrivateIP": "10.0.%d.%d"}`, i, i, i / 250, i % 250 + 1))
+    }
+    return `{"instances": [` + strings.Join(instances, ",") + `]}`
+}
+
+func TestLargeRepliesAreTruncated(t *testing.T) {
+    s := newTestService(t, Config{Group: []string{"web: Role=web"}}, aws.Config{}, groupInventory(100))
+
+    m := new(dns.Msg)
+    m.SetQuestion("web.group.example.com.", dns.TypeA)
+    udp := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+
+    reply := exchange(s, m, udp)
+    if !reply.Truncated || len(reply.Answer) >= 100 {
+        t.Errorf("plain UDP: truncated %v with %d answers", reply.Truncated, len(reply.Answer))
+    }
+    if packed, err := reply.Pack(); err != nil || len(packed) > dns.MinMsgSize {
+        t.Errorf("plain UDP reply is %d bytes: %v", len(packed), err)
+    }
+
+    m.SetEdns0(4096, false)
+    if reply := exchange(s, m, udp); reply.Truncated || len(reply.Answer) != 100 {
+        t.Errorf("EDNS UDP: truncated %v with %d answers", reply.Truncated, len(reply.Answer))
+    }
+
+    m = new(dns.Msg)
+    m.SetQuestion("web.group.example.com.", dns.TypeA)
+    tcp := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+    if reply := exchange(s, m, tcp); reply.Truncated || len(reply.Answer) != 100 {
+        t.Errorf("TCP: truncated %v with %d answers", reply.Truncated, len(reply.Answer))
+    }
+}
+
+func TestGroups(t *testing.T) {
+    inventory := `{"instances": [
+        {"ID": "i-1", "Name": "web-1", "State": "running", "Tags": {"Role": "web", "Env": "prod"}, "PrivateIP": "10.0.1.1"},
+        {"ID": "i-2", "Name": "web-2", "State": "running", "Tags": {"Role": "web", "Env": "staging"}, "PrivateIP": "10.0.1.2"},
+        {"ID": "i-3", "Name": "db-1", "State": "running", "Tags": {"Role": "db", "Env": "prod"}, "PrivateIP": "10.0.2.1"}
+    ]}`
+    s := newTestService(t, Config{Group: []string{"Web: Role=web", "prod-web: Role=web,Env=prod", "cache: Role=cache"}}, aws.Config{}, inventory)
+
+    for _, test := range []struct {
+        name  string
+        rcode int
+        ips   []string
+    }{
+        {"web.group.example.com", dns.RcodeSuccess, []string{"10.0.1.1", "10.0.1.2"}},
+        {"WEB.group.example.com", dns.RcodeSuccess, []string{"10.0.1.1", "10.0.1.2"}},
+        {"prod-web.group.example.com", dns.RcodeSuccess, []string{"10.0.1.1"}},
+        {"cache.group.example.com", dns.RcodeSuccess, nil},
+        {"missing.group.example.com", dns.RcodeNameError, nil},
+    } {
+        reply := query(s, test.name, dns.TypeA)
+        if reply.Rcode != test.rcode {
+            t.Errorf("%s: rcode %s, want %s", test.name, dns.RcodeToString[reply.Rcode], dns.RcodeToString[test.rcode])
+            continue
+        }
+        var ips []string
+        for _, rr := range reply.Answer {
+            ips = append(ips, rr.(*dns.A).A.String())
+        }
+        sort.Strings(ips)
+        if strings.Join(ips, ",") != strings.Join(test.ips, ",") {
+            t.Errorf("%s: got %v, want %v", test.name, ips, test.ips)
+        }
+    }
+}
+
+func TestBadGroupIsRejected(t *testing.T) {
+    for _, entry := range []string{"web", "web: Role in (a", "web: @bogus=1"} {
+        s := NewService(Config{Domain: "example.com", Group: []string{entry}})
+        if err := s.parseConfig(); err == nil || !strings.Contains(err.Error(), "bad Group") {
+            t.Errorf("%q: %v", entry, err)
+        }
+    }
+}
+
+func TestReverse(t *testing.T) {
+    inventory := `{"instances": [
+        {"ID": "i-1", "Name": "web", "State": "running", "PrivateIP": "10.0.1.10", "IPv6Addresses": ["2600:1f18::10"]}
+    ]}`
+    s := newTestService(t, Config{ReverseZone: []string{"10.0.0.0/16", "2600:1f18::/56"}}, aws.Config{}, inventory)
+
+    for _, test := range []struct {
+        name   string
+        qtype  uint16
+        rcode  int
+        answer string
+        soa    string
+    }{
+        {"10.1.0.10.in-addr.arpa", dns.TypePTR, dns.RcodeSuccess, "web.example.com.", ""},
+        {"11.1.0.10.in-addr.arpa", dns.TypePTR, dns.RcodeNameError, "", "0.10.in-addr.arpa."},
+        {"10.1.0.10.in-addr.arpa", dns.TypeA, dns.RcodeSuccess, "", "0.10.in-addr.arpa."},
+        // Names inside the zone that are not addresses exist without records.
+        {"1.0.10.in-addr.arpa", dns.TypePTR, dns.RcodeSuccess, "", "0.10.in-addr.arpa."},
+        {"0.0.10.in-addr.arpa", dns.TypePTR, dns.RcodeSuccess, "", "0.10.in-addr.arpa."},
+        {"0.10.in-addr.arpa", dns.TypePTR, dns.RcodeSuccess, "", "0.10.in-addr.arpa."},
+        {"0.10.in-addr.arpa", dns.TypeSOA, dns.RcodeSuccess, "0.10.in-addr.arpa.", ""},
+        {"0.0.0.0.0.0.0.8.1.f.1.0.0.6.2.ip6.arpa", dns.TypePTR, dns.RcodeSuccess, "", "0.0.0.0.0.0.8.1.f.1.0.0.6.2.ip6.arpa."},
+        {"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.1.f.1.0.0.6.2.ip6.arpa", dns.TypePTR, dns.RcodeSuccess, "web.example.com.", ""},
+        // Outside the ranges, or above their zones.
+        {"10.1.1.11.in-addr.arpa", dns.TypePTR, dns.RcodeRefused, "", ""},
+        {"1.11.in-addr.arpa", dns.TypePTR, dns.RcodeRefused, "", ""},
+        {"10.in-addr.arpa", dns.TypePTR, dns.RcodeRefused, "", ""},
+        {"x.0.10.in-addr.arpa", dns.TypePTR, dns.RcodeRefused, "", ""},
+    } {
+        reply := query(s, test.name, test.qtype)
+        if reply.Rcode != test.rcode {
+            t.Errorf("%s: rcode %s, want %s", test.name, dns.RcodeToString[reply.Rcode], dns.RcodeToString[test.rcode])
+            continue
+        }
+        var answer, soa string
+        for _, rr := range reply.Answer {
+            switch rr := rr.(type) {
+            case *dns.PTR:
+                answer = rr.Ptr
+            case *dns.SOA:
+                answer = rr.Hdr.Name
+            }
+        }
+        for _, rr := range reply.Ns {
+            if rr, ok := rr.(*dns.SOA); ok {
+                soa = rr.Hdr.Name
+            }
+        }
+        if answer != test.answer || soa != test.soa {
+            t.Errorf("%s: answer %q soa %q, want %q %q", test.name, answer, soa, test.answer, test.soa)
+        }
+    }
+}
+
+const nameInventory = `{
+    "instances": [
+        {"ID": "i-1", "Name": "Web", "State": "running", "Tags": {"dns:srv": "_http._tcp:80,_metrics._tcp.web:9100"}, "PrivateIP": "10.0.1.10"},
+        {"ID": "i-2", "Name": "api.prod", "State": "running", "PrivateIP": "10.0.2.20"}
+    ],
+    "ecsTasks": [
+        {"ID": "0123abcd", "Cluster": "main", "Service": "orders", "IPs": ["10.0.3.30"], "Ports": [{"Name": "http", "Port": 8080, "Protocol": "tcp"}]}
+    ]
+}`
+
+func TestNamesAndNonTerminals(t *testing.T) {
+    s := newTestService(t, Config{}, aws.Config{}, nameInventory)
+
+    for _, test := range []struct {
+        name    string
+        qtype   uint16
+        rcode   int
+        answers int
+    }{
+        // Instance names ignore case.
+        {"web.example.com", dns.TypeA, dns.RcodeSuccess, 1},
+        {"WEB.Example.COM", dns.TypeA, dns.RcodeSuccess, 1},
+        {"API.prod.example.com", dns.TypeA, dns.RcodeSuccess, 1},
+        {"web.example.com", dns.TypeMX, dns.RcodeSuccess, 0},
+        {"db.example.com", dns.TypeA, dns.RcodeNameError, 0},
+        // Names with names beneath them exist without records.
+        {"prod.example.com", dns.TypeA, dns.RcodeSuccess, 0},
+        {"_http._tcp.example.com", dns.TypeSRV, dns.RcodeSuccess, 1},
+        {"_tcp.example.com", dns.TypeSRV, dns.RcodeSuccess, 0},
+        {"_tcp.web.example.com", dns.TypeSRV, dns.RcodeSuccess, 0},
+        {"_udp.example.com", dns.TypeSRV, dns.RcodeNameError, 0},
+        {"main.ecs.example.com", dns.TypeA, dns.RcodeSuccess, 0},
+        {"orders.main.ecs.example.com", dns.TypeA, dns.RcodeSuccess, 1},
+        {"_tcp.orders.main.ecs.example.com", dns.TypeSRV, dns.RcodeSuccess, 0},
+        {"_http._tcp.orders.main.ecs.example.com", dns.TypeSRV, dns.RcodeSuccess, 1},
+        {"_udp.orders.main.ecs.example.com", dns.TypeSRV, dns.RcodeNameError, 0},
+        {"other.ecs.example.com", dns.TypeA, dns.RcodeNameError, 0},
+    } {
+        reply := query(s, test.name, test.qtype)
+        if reply.Rcode != test.rcode || len(reply.Answer) != test.answers {
+            t.Errorf("%s %s: %s with %d answers, want %s with %d", test.name, dns.TypeToString[test.qtype],
+                dns.RcodeToString[reply.Rcode], len(reply.Answer), dns.RcodeToString[test.rcode], test.answers)
+        }
+        if test.answers == 0 && len(reply.Ns) != 1 {
+            t.Errorf("%s: negative answer without the SOA", test.name)
+        }
+    }
+}
+
+const srvInventory = `{
+    "instances": [
+        {"ID": "i-1", "Name": "web", "State": "running", "LaunchTime": "2024-01-01T00:00:00Z", "Tags": {"srv": "_http._tcp:80"}, "PrivateIP": "10.0.1.1"},
+        {"ID": "i-2", "Name": "web", "State": "running", "LaunchTime": "2024-02-01T00:00:00Z", "Tags": {"srv": "_http._tcp:80"}, "PrivateIP": "10.0.1.2"},
+        {"ID": "i-3", "Name": "API", "State": "running", "Tags": {"srv": "_http._tcp:8080, bogus, _x:1"}, "PrivateIP": "10.0.2.1"},
+        {"ID": "i-4", "Name": "old", "State": "stopped", "Tags": {"srv": "_http._tcp:80"}, "PrivateIP": "10.0.3.1"}
+    ]
+}`
+
+// srvTargets resolves every SRV target of name to its addresses.
+func srvTargets(s *Service, name string) []string {
+    var targets []string
+    for _, rr := range query(s, name, dns.TypeSRV).Answer {
+        srv := rr.(*dns.SRV)
+        var ips []string
+        for _, rr := range query(s, srv.Target, dns.TypeA).Answer {
+            ips = append(ips, rr.(*dns.A).A.String())
+        }
+        targets = append(targets, fmt.Sprintf("%s:%d=%s", srv.Target, srv.Port, strings.Join(ips, "|")))
+    }
+    sort.Strings(targets)
+    return targets
+}
+
+func TestSRVTargetsResolveToTheirInstance(t *testing.T) {
+    for _, test := range []struct {
+        awsConfig aws.Config
+        targets   []string
+    }{
+        {aws.Config{DuplicateNames: aws.DuplicatesError, UniqueNames: aws.UniqueNamesIndex}, []string{
+            "api.example.com.:8080=10.0.2.1",
+            "web-1.example.com.:80=10.0.1.1",
+            "web-2.example.com.:80=10.0.1.2",
+        }},
+        {aws.Config{UniqueNames: aws.UniqueNamesID}, []string{
+            "api.example.com.:8080=10.0.2.1",
+            "i-1.example.com.:80=10.0.1.1",
+            "i-2.example.com.:80=10.0.1.2",
+        }},
+        // Without unique names only instances owning their name are targets.
+        {aws.Config{}, []string{"api.example.com.:8080=10.0.2.1"}},
+    } {
+        s := newTestService(t, Config{SRVTag: "srv"}, test.awsConfig, srvInventory)
+        if targets := srvTargets(s, "_http._tcp.example.com"); strings.Join(targets, ",") != strings.Join(test.targets, ",") {
+            t.Errorf("%+v: got %v, want %v", test.awsConfig, targets, test.targets)
+        }
+        if reply := query(s, "_x.example.com", dns.TypeSRV); reply.Rcode != dns.RcodeNameError {
+            t.Errorf("malformed entry answered: %s", dns.RcodeToString[reply.Rcode])
+        }
+    }
+}
+
+func TestReverseNamesResolveToTheirInstance(t *testing.T) {
+    inventory := `{"instances": [
+        {"ID": "i-1", "Name": "dup", "State": "running", "LaunchTime": "2024-01-01T00:00:00Z", "PrivateIP": "10.0.1.1"},
+        {"ID": "i-2", "Name": "dup", "State": "running", "LaunchTime": "2024-02-01T00:00:00Z", "PrivateIP": "10.0.1.2"},
+        {"ID": "i-3", "Name": "Web Server", "State": "running", "PrivateIP": "10.0.1.3"},
+        {"ID": "i-4", "Name": "Solo", "State": "running", "PrivateIP": "10.0.1.4"}
+    ]}`
+    for _, test := range []struct {
+        awsConfig aws.Config
+        ptrs      []string
+    }{
+        {aws.Config{UniqueNames: aws.UniqueNamesIndex}, []string{"dup-1.example.com.", "dup-2.example.com.", "", "solo.example.com."}},
+        // A shared name without unique names has no name of its own.
+        {aws.Config{}, []string{"", "", "", "solo.example.com."}},
+    } {
+        s := newTestService(t, Config{ReverseZone: []string{"10.0.0.0/16"}}, test.awsConfig, inventory)
+        for i, want := range test.ptrs {
+            name := fmt.Sprintf("%d.1.0.10.in-addr.arpa", i + 1)
+            reply := query(s, name, dns.TypePTR)
+            if reply.Rcode != dns.RcodeSuccess {
+                t.Errorf("%s: rcode %s", name, dns.RcodeToString[reply.Rcode])
+                continue
+            }
+            ptr := ""
+            for _, rr := range reply.Answer {
+                ptr = rr.(*dns.PTR).Ptr
+            }
+            if ptr != want {
+                t.Errorf("%+v %s: %q, want %q", test.awsConfig, name, ptr, want)
+                continue
+            }
+            if ptr == "" {
+                continue
+            }
+            back := query(s, ptr, dns.TypeA)
+            if len(back.Answer) != 1 || back.Answer[0].(*dns.A).A.String() != fmt.Sprintf("10.0.1.%d", i + 1) {
+                t.Errorf("%s does not resolve back to 10.0.1.%d alone: %v", ptr, i + 1, back.Answer)
+            }
+        }
+    }
+}
+
+func TestScopeLabelsIgnoreCase(t *testing.T) {
+    inventory := `{"instances": [
+        {"ID": "i-1", "Name": "web", "State": "running", "Source": "Prod", "Region": "us-east-1", "PrivateIP": "10.0.1.1"},
+        {"ID": "i-2", "Name": "web", "State": "running", "Source": "staging", "Region": "eu-west-1", "PrivateIP": "10.0.2.1"}
+    ]}`
+    s := newTestService(t, Config{}, aws.Config{}, inventory)
+
+    for _, test := range []struct {
+        name string
+        ip   string
+    }{
+        {"web.us-east-1.example.com", "10.0.1.1"},
+        {"web.US-EAST-1.example.com", "10.0.1.1"},
+        {"WEB.Eu-West-1.example.com", "10.0.2.1"},
+        {"web.prod.example.com", "10.0.1.1"},
+        {"web.PROD.example.com", "10.0.1.1"},
+        {"web.Staging.example.com", "10.0.2.1"},
+    } {
+        reply := query(s, test.name, dns.TypeA)
+        if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != test.ip {
+            t.Errorf("%s: %v, want %s", test.name, reply.Answer, test.ip)
+        }
+    }
+}
+
+// subnetQuery asks for name's A records carrying an EDNS Client Subnet
+// option for cidr.
+func subnetQuery(name string, cidr string) *dns.Msg {
+    _, ipNet, _ := net.ParseCIDR(cidr)
+    ones, _ := ipNet.Mask.Size()
+    m := new(dns.Msg)
+    m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+    m.SetEdns0(dns.DefaultMsgSize, false)
+    m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+        Code: dns.EDNS0SUBNET,
+        Family: 1,
+        SourceNetmask: uint8(ones),
+        Address: ipNet.IP,
+    })
+    return m
+}
+
+func replySubnet(reply *dns.Msg) *dns.EDNS0_SUBNET {
+    if opt := reply.IsEdns0(); opt != nil {
+        for _, option := range opt.Option {
+            if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+                return subnet
+            }
+        }
+    }
+    return nil
+}
+
+func TestViews(t *testing.T) {
+    inventory := `{"instances": [
+        {"ID": "i-1", "Name": "web", "State": "running", "PrivateIP": "10.0.1.10", "PublicIP": "54.0.0.10"}
+    ]}`
+    views := map[string]*ViewConfig{"office": {Client: []string{"10.0.0.0/16"}, Answer: AnswerPrivate}}
+    resolver := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 5353}
+
+    // Without ClientSubnet the source address picks the view.
+    s := newTestService(t, Config{Views: views, DefaultAnswer: AnswerPublic}, aws.Config{}, inventory)
+    for _, test := range []struct {
+        remote net.IP
+        ip     string
+    }{
+        {net.IPv4(10, 0, 5, 5), "10.0.1.10"},
+        {net.IPv4(198, 51, 100, 7), "54.0.0.10"},
+    } {
+        m := new(dns.Msg)
+        m.SetQuestion("web.example.com.", dns.TypeA)
+        reply := exchange(s, m, &net.UDPAddr{IP: test.remote, Port: 5353})
+        if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != test.ip {
+            t.Errorf("from %s: %v, want %s", test.remote, reply.Answer, test.ip)
+        }
+    }
+    // The subnet is ignored and not echoed unless ClientSubnet is set.
+    reply := exchange(s, subnetQuery("web.example.com", "10.0.5.0/24"), resolver)
+    if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "54.0.0.10" || replySubnet(reply) != nil {
+        t.Errorf("subnet used without ClientSubnet: %v", reply)
+    }
+
+    // With ClientSubnet the subnet a resolver forwards picks the view, and
+    // the scope tells the resolver how far the answer applies.
+    s = newTestService(t, Config{Views: views, DefaultAnswer: AnswerPublic, ClientSubnet: true}, aws.Config{}, inventory)
+    for _, test := range []struct {
+        cidr  string
+        ip    string
+        scope uint8
+    }{
+        {"10.0.5.0/24", "10.0.1.10", 16},
+        {"198.51.100.0/24", "54.0.0.10", 24},
+    } {
+        reply := exchange(s, subnetQuery("web.example.com", test.cidr), resolver)
+        if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != test.ip {
+            t.Errorf("subnet %s: %v, want %s", test.cidr, reply.Answer, test.ip)
+        }
+        subnet := replySubnet(reply)
+        if subnet == nil || subnet.SourceScope != test.scope || subnet.SourceNetmask != 24 {
+            t.Errorf("subnet %s: echoed %v, want scope %d", test.cidr, subnet, test.scope)
+        }
+    }
+    // A query without a subnet still falls back to its source address.
+    m := new(dns.Msg)
+    m.SetQuestion("web.example.com.", dns.TypeA)
+    reply = exchange(s, m, &net.UDPAddr{IP: net.IPv4(10, 0, 9, 9), Port: 5353})
+    if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "10.0.1.10" || replySubnet(reply) != nil {
+        t.Errorf("no subnet from 10.0.9.9: %v", reply)
+    }
+}
+
+func TestASGAnswersHealthyMembers(t *testing.T) {
+    inventory := `{
+        "instances": [
+            {"ID": "i-1", "Name": "web-1", "State": "running", "PrivateIP": "10.0.1.1"},
+            {"ID": "i-2", "Name": "web-2", "State": "running", "PrivateIP": "10.0.1.2"},
+            {"ID": "i-3", "Name": "web-3", "State": "running", "PrivateIP": "10.0.1.3"},
+            {"ID": "i-4", "Name": "web-4", "State": "running", "PrivateIP": "10.0.1.4"}
+        ],
+        "autoScalingGroups": [
+            {"Name": "web", "Instances": [
+                {"ID": "i-1", "LifecycleState": "InService", "HealthStatus": "Healthy"},
+                {"ID": "i-2", "LifecycleState": "InService", "HealthStatus": "Healthy"},
+                {"ID": "i-3", "LifecycleState": "InService", "HealthStatus": "Unhealthy"},
+                {"ID": "i-4", "LifecycleState": "Pending", "HealthStatus": "Healthy"}
+            ]},
+            {"Name": "draining", "Instances": [
+                {"ID": "i-4", "LifecycleState": "Terminating", "HealthStatus": "Healthy"}
+            ]}
+        ]
+    }`
+    s := newTestService(t, Config{DefaultAnswer: AnswerPrivate}, aws.Config{}, inventory)
+
+    for _, test := range []struct {
+        name  string
+        rcode int
+        ips   string
+    }{
+        {"web.asg.example.com", dns.RcodeSuccess, "10.0.1.1,10.0.1.2"},
+        {"WEB.asg.example.com", dns.RcodeSuccess, "10.0.1.1,10.0.1.2"},
+        // A group without healthy members exists but has no addresses.
+        {"draining.asg.example.com", dns.RcodeSuccess, ""},
+        {"missing.asg.example.com", dns.RcodeNameError, ""},
+    } {
+        reply := query(s, test.name, dns.TypeA)
+        var ips []string
+        for _, rr := range reply.Answer {
+            ips = append(ips, rr.(*dns.A).A.String())
+        }
+        sort.Strings(ips)
+        if reply.Rcode != test.rcode || strings.Join(ips, ",") != test.ips {
+            t.Errorf("%s: %s %v, want %s %s", test.name, dns.RcodeToString[reply.Rcode], ips, dns.RcodeToString[test.rcode], test.ips)
+        }
+    }
+}
@@ -0,0 +1,64 @@
+package named
+
+import (
+    "strings"
+
+    "github.com/miekg/dns"
+    "github.com/page31/aws-meta-server/services/aws"
+)
+
+const maxTXTString = 255
+
+// answerSRV answers _<service>._<proto>[.<name>] with an SRV record for
+// every instance listing it in its SRV tag, pointing at a name that
+// resolves to that instance alone. Names such as _<proto> above a listed
+// name exist without records.
+func (s *Service) answerSRV(q dns.Question, name string) (answers []dns.RR, exists bool) {
+    targets, exists := s.AWSService.GetSRVTargets(name)
+    if q.Qtype != dns.TypeSRV {
+        return nil, exists
+    }
+    for _, target := range targets {
+        fqdn := dns.Fqdn(target.Name + "." + s.Config.Domain)
+        if _, ok := dns.IsDomainName(fqdn); !ok {
+            continue
+        }
+        answers = append(answers, &dns.SRV{
+            Hdr: s.header(q, dns.TypeSRV),
+            Priority: 0,
+            Weight: 1,
+            Port: target.Port,
+            Target: fqdn,
+        })
+    }
+    return answers, exists
+}
+
+// tagStrings renders the TXTTag tags the instance has as "key=value"
+// strings (RFC 1464), in the configured order.
+func (s *Service) tagStrings(inst aws.EC2Instance) []string {
+    var values []string
+    for _, key := range s.Config.TXTTag {
+        value, ok := inst.Tags[strings.TrimSpace(key)]
+        if !ok {
+            continue
+        }
+        txt := strings.TrimSpace(key) + "=" + value
+        if len(txt) > maxTXTString {
+            txt = txt[:maxTXTString]
+        }
+        values = append(values, txt)
+    }
+    return values
+}
+
+func (s *Service) txt(q dns.Question, inst aws.EC2Instance) []dns.RR {
+    values := s.tagStrings(inst)
+    if len(values) == 0 {
+        return nil
+    }
+    return []dns.RR{&dns.TXT{
+        Hdr: s.header(q, dns.TypeTXT),
+        Txt: values,
+    }}
+}
@@ -0,0 +1,169 @@
+package named
+
+import (
+    "fmt"
+    "net"
+    "sort"
+    "strings"
+
+    "github.com/miekg/dns"
+    "github.com/page31/aws-meta-server/services/aws"
+)
+
+// How a view answers instance names.
+const (
+    AnswerPrivate     = "private"
+    AnswerPublic      = "public"
+    AnswerPublicCNAME = "public-cname"
+    defaultViewName   = "default"
+)
+
+// ViewConfig describes one split-horizon view, read from a
+// [DNSView "name"] section. Clients inside any of the Client CIDRs get
+// instance names answered the Answer way.
+type ViewConfig struct {
+    Client []string
+    Answer string
+}
+
+type view struct {
+    name   string
+    answer string
+    nets   []*net.IPNet
+}
+
+func parseAnswer(answer string, fallback string) (error, string) {
+    switch answer = strings.ToLower(strings.TrimSpace(answer)); answer {
+    case "":
+        return nil, fallback
+    case AnswerPrivate, AnswerPublic, AnswerPublicCNAME:
+        return nil, answer
+    }
+    return fmt.Errorf("bad answer %q: expected %s, %s or %s", answer, AnswerPrivate, AnswerPublic, AnswerPublicCNAME), ""
+}
+
+// parseViews reads the configured views, sorted by name so overlapping
+// ranges of the same length always pick the same view, and the view for
+// clients outside all of them.
+func parseViews(c *Config) (error, []*view, *view) {
+    err, answer := parseAnswer(c.DefaultAnswer, AnswerPublicCNAME)
+    if err != nil {
+        return fmt.Errorf("bad DefaultAnswer: %s", err.Error()), nil, nil
+    }
+    fallback := &view{name: defaultViewName, answer: answer}
+    names := make([]string, 0, len(c.Views))
+    for name := range c.Views {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    views := make([]*view, 0, len(names))
+    for _, name := range names {
+        vc := c.Views[name]
+        err, answer := parseAnswer(vc.Answer, AnswerPrivate)
+        if err != nil {
+            return fmt.Errorf("view %s: %s", name, err.Error()), nil, nil
+        }
+        v := &view{name: name, answer: answer}
+        for _, cidr := range vc.Client {
+            _, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+            if err != nil {
+                return fmt.Errorf("view %s: bad Client %q: %s", name, cidr, err.Error()), nil, nil
+            }
+            v.nets = append(v.nets, ipNet)
+        }
+        if len(v.nets) == 0 {
+            return fmt.Errorf("view %s: no Client ranges", name), nil, nil
+        }
+        views = append(views, v)
+    }
+    return nil, views, fallback
+}
+
+// clientView picks the view whose range holds the client most specifically,
+// along with that range's prefix length for the EDNS Client Subnet scope.
+// The client is the ECS address when ClientSubnet is set and the query
+// carries one, the source address otherwise.
+func (s *Service) clientView(w dns.ResponseWriter, r *dns.Msg) (*view, *dns.EDNS0_SUBNET) {
+    var ip net.IP
+    var subnet *dns.EDNS0_SUBNET
+    if s.Config.ClientSubnet {
+        if subnet = requestSubnet(r); subnet != nil {
+            ip = subnet.Address
+        }
+    }
+    if ip == nil {
+        switch addr := w.RemoteAddr().(type) {
+        case *net.UDPAddr:
+            ip = addr.IP
+        case *net.TCPAddr:
+            ip = addr.IP
+        }
+    }
+    selected, best := s.defaultView, -1
+    for _, v := range s.views {
+        for _, ipNet := range v.nets {
+            if ones, _ := ipNet.Mask.Size(); ones > best && ip != nil && ipNet.Contains(ip) {
+                selected, best = v, ones
+            }
+        }
+    }
+    if subnet != nil {
+        scope := subnet.SourceNetmask
+        if best >= 0 && best < int(scope) {
+            scope = uint8(best)
+        }
+        subnet = &dns.EDNS0_SUBNET{
+            Code: dns.EDNS0SUBNET,
+            Family: subnet.Family,
+            SourceNetmask: subnet.SourceNetmask,
+            SourceScope: scope,
+            Address: subnet.Address,
+        }
+    }
+    return selected, subnet
+}
+
+func requestSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+    opt := r.IsEdns0()
+    if opt == nil {
+        return nil
+    }
+    for _, option := range opt.Option {
+        if subnet, ok := option.(*dns.EDNS0_SUBNET); ok && len(subnet.Address) > 0 {
+            return subnet
+        }
+    }
+    return nil
+}
+
+// setSubnet echoes the client subnet with the scope the answer is valid
+// for (RFC 7871), so caching resolvers keep one answer per view.
+func setSubnet(reply *dns.Msg, r *dns.Msg, subnet *dns.EDNS0_SUBNET) {
+    if subnet == nil {
+        return
+    }
+    opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+    size := r.IsEdns0().UDPSize()
+    if size < dns.MinMsgSize {
+        size = dns.MinMsgSize
+    }
+    opt.SetUDPSize(size)
+    opt.Option = append(opt.Option, subnet)
+    reply.Extra = append(reply.Extra, opt)
+}
+
+// instanceIPs lists the IPv4 address the view prefers, falling back to the
+// other one, and every IPv6 address of the instance.
+func (v *view) instanceIPs(inst aws.EC2Instance) []string {
+    ips := make([]string, 0, len(inst.IPv6Addresses) + 1)
+    first, second := inst.PublicIP, inst.PrivateIP
+    if v.answer == AnswerPrivate {
+        first, second = second, first
+    }
+    if first != "" {
+        ips = append(ips, first)
+    } else if second != "" {
+        ips = append(ips, second)
+    }
+    return append(ips, inst.IPv6Addresses...)
+}